@@ -0,0 +1,87 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+type aclMode int
+
+// listener access modes, sent in cmsgListenerACL
+const (
+	aclOpen    aclMode = iota // accept every peer
+	aclFriends                // accept only friends
+	aclAllow                  // accept only listed peers
+	aclDeny                   // accept all but listed peers
+	aclAsk                    // ask the client with smsgListenerRequest
+)
+
+type aclDecision int
+
+const (
+	aclAccept aclDecision = iota
+	aclReject
+	aclAskClient
+)
+
+const listenerRequestTimeout = 30 * time.Second
+
+type listenerACL struct {
+	mode  aclMode
+	peers map[peer.ID]bool
+}
+
+var openACL = &listenerACL{aclOpen, nil}
+
+func createListenerACL(mode int, peers []string) (*listenerACL, error) {
+	if mode < int(aclOpen) || mode > int(aclAsk) {return nil, fmt.Errorf("bad listener access mode: %d", mode)}
+	acl := &listenerACL{aclMode(mode), make(map[peer.ID]bool)}
+	for _, peerString := range peers {
+		peerID, err := peer.Decode(peerString)
+		if err != nil {return nil, fmt.Errorf("error decoding peerID %s: %w", peerString, err)}
+		acl.peers[peerID] = true
+	}
+	return acl, nil
+}
+
+func (acl *listenerACL) check(peerID peer.ID) aclDecision {
+	switch acl.mode {
+	case aclFriends:
+		if isFriend(peerID) {return aclAccept}
+	case aclAllow:
+		if acl.peers[peerID] {return aclAccept}
+	case aclDeny:
+		if !acl.peers[peerID] {return aclAccept}
+	case aclAsk:
+		return aclAskClient
+	default:
+		return aclAccept
+	}
+	return aclReject
+}
@@ -0,0 +1,249 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+/*
+# BLOCKLIST
+
+Blocked peers and IP ranges are refused at dial and accept time by a libp2p ConnectionGater,
+so they never reach listeners. Entries are peer IDs, IP addresses, or CIDR ranges and are
+kept in the datastore.
+
+```
+  Command line:
+    libp2p-websocket block list
+    libp2p-websocket block add ENTRY...
+    libp2p-websocket block remove ENTRY...
+```
+*/
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	ipfslite "github.com/hsanjuan/ipfs-lite"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/control"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const blocklistPrefix = "/libp2p-websocket/blocklist/"
+
+// blocklist implements connmgr.ConnectionGater
+type blocklist struct {
+	lock  sync.RWMutex
+	peers map[peer.ID]bool
+	nets  map[string]*net.IPNet // entry -> range
+}
+
+var blocked = createBlocklist()
+
+func createBlocklist() *blocklist {
+	b := new(blocklist)
+	b.peers = make(map[peer.ID]bool)
+	b.nets = make(map[string]*net.IPNet)
+	return b
+}
+
+func blocklistKey(entry string) datastore.Key {
+	return datastore.NewKey(blocklistPrefix + hex.EncodeToString([]byte(entry)))
+}
+
+// parseBlockEntry returns either a peer ID or an IP range for entry
+func parseBlockEntry(entry string) (peer.ID, *net.IPNet, error) {
+	if strings.Contains(entry, "/") {
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {return "", nil, fmt.Errorf("bad IP range %s: %w", entry, err)}
+		return "", ipNet, nil
+	}
+	if ip := net.ParseIP(entry); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		return "", &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	peerID, err := peer.Decode(entry)
+	if err != nil {return "", nil, fmt.Errorf("%s is not a peer id, IP address, or IP range", entry)}
+	return peerID, nil, nil
+}
+
+// load reads the blocklist from the datastore
+func (b *blocklist) load(dstor datastore.Datastore) error {
+	results, err := dstor.Query(query.Query{Prefix: blocklistPrefix})
+	if err != nil {return err}
+	entries, err := results.Rest()
+	if err != nil {return err}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, entry := range entries {
+		if err := b.addPrim(string(entry.Value)); err != nil {
+			fmt.Println("BAD BLOCKLIST ENTRY", entry.Key, err)
+		}
+	}
+	return nil
+}
+
+func (b *blocklist) addPrim(entry string) error {
+	peerID, ipNet, err := parseBlockEntry(entry)
+	if err != nil {return err}
+	if ipNet != nil {
+		b.nets[entry] = ipNet
+	} else {
+		b.peers[peerID] = true
+	}
+	return nil
+}
+
+// change adds and removes entries, saving them if there is a datastore
+func (b *blocklist) change(dstor datastore.Datastore, add []string, remove []string) error {
+	for _, entry := range append(append([]string{}, add...), remove...) {
+		if _, _, err := parseBlockEntry(entry); err != nil {return err}
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, entry := range add {
+		b.addPrim(entry)
+		if dstor != nil {
+			if err := dstor.Put(blocklistKey(entry), []byte(entry)); err != nil {return err}
+		}
+	}
+	for _, entry := range remove {
+		peerID, ipNet, _ := parseBlockEntry(entry)
+		if ipNet != nil {
+			delete(b.nets, entry)
+		} else {
+			delete(b.peers, peerID)
+		}
+		if dstor != nil {
+			if err := dstor.Delete(blocklistKey(entry)); err != nil {return err}
+		}
+	}
+	return nil
+}
+
+func (b *blocklist) entries() []string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	entries := make([]string, 0, len(b.peers)+len(b.nets))
+	for peerID := range b.peers {
+		entries = append(entries, peerID.Pretty())
+	}
+	for entry := range b.nets {
+		entries = append(entries, entry)
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+func (b *blocklist) blockedPeer(peerID peer.ID) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.peers[peerID]
+}
+
+func (b *blocklist) blockedAddr(addr ma.Multiaddr) bool {
+	ipString, err := addr.ValueForProtocol(ma.P_IP4)
+	if err != nil {
+		ipString, err = addr.ValueForProtocol(ma.P_IP6)
+	}
+	if err != nil {return false}
+	ip := net.ParseIP(ipString)
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for _, ipNet := range b.nets {
+		if ipNet.Contains(ip) {return true}
+	}
+	return false
+}
+
+func (b *blocklist) InterceptPeerDial(peerID peer.ID) bool {
+	return !b.blockedPeer(peerID)
+}
+
+func (b *blocklist) InterceptAddrDial(peerID peer.ID, addr ma.Multiaddr) bool {
+	return !b.blockedPeer(peerID) && !b.blockedAddr(addr)
+}
+
+func (b *blocklist) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	return !b.blockedAddr(addrs.RemoteMultiaddr())
+}
+
+func (b *blocklist) InterceptSecured(dir network.Direction, peerID peer.ID, addrs network.ConnMultiaddrs) bool {
+	if b.blockedPeer(peerID) || b.blockedAddr(addrs.RemoteMultiaddr()) {
+		fmt.Printf("REFUSING BLOCKED PEER %s AT %s\n", peerID.Pretty(), addrs.RemoteMultiaddr())
+		countRefusal("blocked")
+		return false
+	}
+	return true
+}
+
+func (b *blocklist) InterceptUpgraded(con network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+// disconnectBlocked closes existing connections that the blocklist now refuses
+func disconnectBlocked() {
+	if conf.myHost == nil {return}
+	for _, con := range conf.myHost.Network().Conns() {
+		if blocked.blockedPeer(con.RemotePeer()) || blocked.blockedAddr(con.RemoteMultiaddr()) {
+			fmt.Println("CLOSING CONNECTION TO BLOCKED PEER", con.RemotePeer().Pretty())
+			conf.myHost.Network().ClosePeer(con.RemotePeer())
+		}
+	}
+}
+
+// blockCommand runs "block list", "block add ENTRY..." or "block remove ENTRY..." from the command line
+func blockCommand(args []string) error {
+	if len(args) == 0 {return fmt.Errorf("usage: block list | block add ENTRY... | block remove ENTRY...")}
+	path, err := datastorePath()
+	if err != nil {return err}
+	dstor, err := ipfslite.BadgerDatastore(path)
+	if err != nil {return err}
+	defer dstor.Close()
+	if err := blocked.load(dstor); err != nil {return err}
+	switch args[0] {
+	case "list":
+	case "add":
+		err = blocked.change(dstor, args[1:], nil)
+	case "remove":
+		err = blocked.change(dstor, nil, args[1:])
+	default:
+		return fmt.Errorf("usage: block list | block add ENTRY... | block remove ENTRY...")
+	}
+	if err != nil {return err}
+	for _, entry := range blocked.entries() {
+		fmt.Println(entry)
+	}
+	return nil
+}
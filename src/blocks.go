@@ -0,0 +1,139 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+/*
+# BLOCK INSPECTION
+
+These endpoints help debug tree sync by showing what the relay can see for a CID:
+
+```
+  /block/CID -- raw block bytes, X-Block-Location header is "local" or "network"
+  /dag/CID   -- the block decoded as a DAG-PB, DAG-CBOR, or raw node, as JSON
+```
+
+Blocks come from the local blockstore when present, otherwise from a network session.
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+const (
+	blockLocal   = "local"
+	blockNetwork = "network"
+	blockTimeout = 30 * time.Second
+)
+
+type dagNodeInfo struct {
+	Cid      string
+	Codec    string
+	Location string // local or network
+	Size     int
+	Links    []*ipld.Link
+	Node     interface{} // the node's own JSON encoding or its raw bytes
+}
+
+// fetchBlock gets a block from the local blockstore or, failing that, from a network session
+func fetchBlock(ctx context.Context, c cid.Cid) (blocks.Block, string, error) {
+	if conf.lite == nil {return nil, "", fmt.Errorf("IPFS is not running")}
+	has, err := conf.lite.HasBlock(c)
+	if err != nil {return nil, "", err}
+	if has {
+		block, err := conf.lite.BlockStore().Get(c)
+		if err != nil {return nil, "", err}
+		return block, blockLocal, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, blockTimeout)
+	defer cancel()
+	node, err := conf.lite.Session(ctx).Get(ctx, c)
+	if err != nil {return nil, "", err}
+	return node, blockNetwork, nil
+}
+
+func decodeDagNode(ctx context.Context, cidString string) (*dagNodeInfo, error) {
+	c, err := cid.Decode(cidString)
+	if err != nil {return nil, fmt.Errorf("bad cid %s: %w", cidString, err)}
+	block, location, err := fetchBlock(ctx, c)
+	if err != nil {return nil, err}
+	node, err := ipld.Decode(block)
+	if err != nil {return nil, fmt.Errorf("could not decode block %s: %w", c, err)}
+	info := &dagNodeInfo{
+		Cid:      c.String(),
+		Codec:    cid.CodecToStr[c.Type()],
+		Location: location,
+		Size:     len(block.RawData()),
+		Links:    node.Links(),
+		Node:     node.RawData(),
+	}
+	if _, ok := node.(json.Marshaler); ok {
+		info.Node = node
+	}
+	return info, nil
+}
+
+func handleBlock(w http.ResponseWriter, r *http.Request) {
+	cidString := r.URL.Path[len("/block/"):]
+	fmt.Printf("Handling %s (%s)\n", r.URL, cidString)
+	c, err := cid.Decode(cidString)
+	if err != nil {
+		httpError(w, fmt.Sprintf("Bad cid: %s", cidString), http.StatusBadRequest)
+		return
+	}
+	block, location, err := fetchBlock(r.Context(), c)
+	if err != nil {
+		httpError(w, fmt.Sprintf("Could not fetch block %s: %s", cidString, err), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Block-Location", location)
+	http.ServeContent(w, r, c.String(), time.Now(), bytes.NewReader(block.RawData()))
+}
+
+func handleDag(w http.ResponseWriter, r *http.Request) {
+	cidString := r.URL.Path[len("/dag/"):]
+	fmt.Printf("Handling %s (%s)\n", r.URL, cidString)
+	info, err := decodeDagNode(r.Context(), cidString)
+	if err != nil {
+		httpError(w, fmt.Sprintf("Could not decode %s: %s", cidString, err), http.StatusNotFound)
+		return
+	}
+	output, err := json.Marshal(info)
+	if err != nil {
+		httpError(w, errstr("Could not encode result %v", info), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Block-Location", info.Location)
+	http.ServeContent(w, r, "output.json", time.Now(), bytes.NewReader(output))
+}
@@ -0,0 +1,195 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+/*
+# CAR FILES
+
+Trees can be moved between machines as CARv1 files.
+
+A ROOT is either a CID or PEERID/TREENAME, which uses the root of that peer's tree
+(TREENAME defaults to the relay's tree name).
+
+```
+  HTTP:
+    GET  /car/export/ROOT -- download a CAR file containing the DAG under ROOT
+    POST /car/import      -- store and pin the CAR file in the request body, returns its roots as JSON
+
+  Command line:
+    libp2p-websocket car export ROOT FILE
+    libp2p-websocket car import FILE
+```
+
+An export whose root cannot be fetched is refused with 404. A block that fails after the CAR has
+started aborts the connection, so the client does not mistake a truncated CAR for a whole one.
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car"
+	"github.com/libp2p/go-libp2p-core/peer"
+	treerequest "github.com/zot/textcraft-treerequest"
+)
+
+const (
+	treeReadyTimeout = 30 * time.Second
+	carRootTimeout   = 30 * time.Second // how long to look for a root before refusing to export it
+)
+
+// resolveCarRoot returns the CID for a ROOT, which is either a CID or PEERID/TREENAME
+func resolveCarRoot(ctx context.Context, root string) (cid.Cid, error) {
+	if c, err := cid.Decode(root); err == nil {return c, nil}
+	peerString := root
+	treeName := conf.treeName
+	if ind := strings.Index(root, "/"); ind != -1 {
+		peerString = root[:ind]
+		treeName = root[ind+1:]
+	}
+	peerID, err := peer.Decode(peerString)
+	if err != nil {return cid.Undef, fmt.Errorf("root %s is neither a cid nor a peer id", root)}
+	if conf.lite == nil {return cid.Undef, fmt.Errorf("IPFS is not running")}
+	select {
+	case <-treeReady:
+	case <-ctx.Done():
+		return cid.Undef, ctx.Err()
+	case <-time.After(treeReadyTimeout):
+		return cid.Undef, fmt.Errorf("tree service is not ready")
+	}
+	tree, err := treerequest.GetTree(treeName, peerID)
+	if err != nil {return cid.Undef, fmt.Errorf("no tree %s for peer %s: %w", treeName, peerID.Pretty(), err)}
+	return tree.Root(), nil
+}
+
+// exportCar writes the DAG under root to w, fetching blocks from the network if needed
+func exportCar(ctx context.Context, root cid.Cid, w io.Writer) error {
+	if conf.lite == nil {return fmt.Errorf("IPFS is not running")}
+	fmt.Println("EXPORTING CAR FOR", root)
+	return car.WriteCar(ctx, conf.lite, []cid.Cid{root}, w)
+}
+
+// importCar stores the blocks of a CAR file and recursively pins its roots
+func importCar(ctx context.Context, r io.Reader) ([]cid.Cid, error) {
+	if conf.lite == nil {return nil, fmt.Errorf("IPFS is not running")}
+	header, err := car.LoadCar(conf.lite.BlockStore(), r)
+	if err != nil {return nil, fmt.Errorf("could not load car: %w", err)}
+	for _, root := range header.Roots {
+		fmt.Println("PINNING CAR ROOT", root)
+		node, err := conf.lite.Get(ctx, root)
+		if err != nil {return nil, fmt.Errorf("could not get car root %s: %w", root, err)}
+		err = conf.pin.Pin(ctx, node, true)
+		if err != nil {return nil, fmt.Errorf("could not pin car root %s: %w", root, err)}
+	}
+	if err := conf.pin.Flush(ctx); err != nil {return nil, err}
+	return header.Roots, nil
+}
+
+func handleCarExport(w http.ResponseWriter, r *http.Request) {
+	rootString := r.URL.Path[len("/car/export/"):]
+	fmt.Printf("Handling %s (%s)\n", r.URL, rootString)
+	if conf.lite == nil {
+		httpError(w, "IPFS is not running", http.StatusInternalServerError)
+		return
+	}
+	root, err := resolveCarRoot(r.Context(), rootString)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	// the CAR header goes out before any block is fetched, so make sure the root can be
+	ctx, cancel := context.WithTimeout(r.Context(), carRootTimeout)
+	_, err = conf.lite.Get(ctx, root)
+	cancel()
+	if err != nil {
+		httpError(w, fmt.Sprintf("Could not get %s: %s", root, err), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.ipld.car")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.car\"", root))
+	if err := exportCar(r.Context(), root, w); err != nil {
+		fmt.Printf("ERROR EXPORTING CAR FOR %s, ABORTING THE RESPONSE: %v\n", root, err)
+		panic(http.ErrAbortHandler) // the client must not mistake a truncated CAR for a whole one
+	}
+}
+
+func handleCarImport(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Handling %s\n", r.URL)
+	if r.Method != http.MethodPost {
+		httpError(w, "Car import requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+	roots, err := importCar(r.Context(), r.Body)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rootStrings := make([]string, len(roots))
+	for i, root := range roots {
+		rootStrings[i] = root.String()
+	}
+	output, err := json.Marshal(rootStrings)
+	if err != nil {
+		httpError(w, errstr("Could not encode result %v", rootStrings), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, "output.json", time.Now(), bytes.NewReader(output))
+}
+
+// carCommand runs "car export ROOT FILE" or "car import FILE" from the command line
+func carCommand(args []string) error {
+	if len(args) == 0 {return fmt.Errorf("usage: car export ROOT FILE | car import FILE")}
+	switch {
+	case args[0] == "export" && len(args) == 3:
+		if err := startForCommand(); err != nil {return err}
+		root, err := resolveCarRoot(context.Background(), args[1])
+		if err != nil {return err}
+		file, err := os.Create(args[2])
+		if err != nil {return err}
+		defer file.Close()
+		if err := exportCar(context.Background(), root, file); err != nil {return err}
+		fmt.Println("Exported", root, "to", args[2])
+	case args[0] == "import" && len(args) == 2:
+		file, err := os.Open(args[1])
+		if err != nil {return err}
+		defer file.Close()
+		if err := startForCommand(); err != nil {return err}
+		roots, err := importCar(context.Background(), file)
+		if err != nil {return err}
+		fmt.Println("Imported and pinned", roots)
+	default:
+		return fmt.Errorf("usage: car export ROOT FILE | car import FILE")
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+/*
+# CONNECTION MANAGER
+
+The connection manager trims connections when there are more than the high water mark, down to
+the low water mark, sparing connections younger than the grace period.
+
+```
+  -connlow N     -- low water mark
+  -connhigh N    -- high water mark
+  -conngrace D   -- grace period for new connections
+```
+
+Peers are never trimmed while a client has a connection to them. Each connection protects its
+peer with its own tag and releases it when the connection closes, so a peer stays protected
+exactly as long as it has connections. Friends are always protected.
+*/
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	connmgr "github.com/libp2p/go-libp2p-connmgr"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const friendTag = "friend"
+
+var connManagerConfig = struct {
+	low   int           // low water mark
+	high  int           // high water mark
+	grace time.Duration // grace period for new connections
+}{50, 300, time.Minute}
+
+var nextProtectTag uint64 // use atomic ops
+
+func newConnManager() *connmgr.BasicConnMgr {
+	return connmgr.NewConnManager(connManagerConfig.low, connManagerConfig.high, connManagerConfig.grace)
+}
+
+// protect keeps the connection's peer from being trimmed until the connection closes
+func (con *libp2pConnection) protect() {
+	con.protectTag = fmt.Sprintf("websocket-%d", atomic.AddUint64(&nextProtectTag, 1))
+	conf.myHost.ConnManager().Protect(con.peerID, con.protectTag)
+}
+
+func (con *libp2pConnection) unprotect() {
+	conf.myHost.ConnManager().Unprotect(con.peerID, con.protectTag)
+}
+
+func protectFriend(peerID peer.ID) {
+	if conf.myHost != nil {
+		conf.myHost.ConnManager().Protect(peerID, friendTag)
+	}
+}
+
+func unprotectFriend(peerID peer.ID) {
+	if conf.myHost != nil {
+		conf.myHost.ConnManager().Unprotect(peerID, friendTag)
+	}
+}
@@ -0,0 +1,194 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+/*
+# CONNECTION STATUS
+
+Each Peer Connection and Listener Connection is followed by a Connection Status message
+describing the libp2p connection that carries the stream. A stream stays on the connection it
+was opened on, so when a direct connection appears to a peer whose streams are relayed,
+Connection Status is sent again for those streams with DIRECTADDR set; the client can open a
+new stream to get off the relay.
+*/
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/sec"
+	secio "github.com/libp2p/go-libp2p-secio"
+	libp2ptls "github.com/libp2p/go-libp2p-tls"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+)
+
+// recordingSecurity remembers which security protocol each connection negotiated
+type recordingSecurity struct {
+	sec.SecureTransport
+	name string
+}
+
+var connSecurity sync.Map // connKey -> security protocol name
+
+func connKey(peerID peer.ID, remote ma.Multiaddr) string {
+	return peerID.Pretty() + " " + remote.String()
+}
+
+// securityOptions are the security transports, wrapped to record what each connection uses
+func securityOptions() []libp2p.Option {
+	return []libp2p.Option{
+		libp2p.Security(libp2ptls.ID, func(key crypto.PrivKey) (sec.SecureTransport, error) {
+			t, err := libp2ptls.New(key)
+			if err != nil {return nil, err}
+			return &recordingSecurity{t, "tls"}, nil
+		}),
+		libp2p.Security(secio.ID, func(key crypto.PrivKey) (sec.SecureTransport, error) {
+			t, err := secio.New(key)
+			if err != nil {return nil, err}
+			return &recordingSecurity{t, "secio"}, nil
+		}),
+	}
+}
+
+func (s *recordingSecurity) record(conn sec.SecureConn, err error) (sec.SecureConn, error) {
+	if err != nil {return conn, err}
+	if remote, maErr := manet.FromNetAddr(conn.RemoteAddr()); maErr == nil {
+		connSecurity.Store(connKey(conn.RemotePeer(), remote), s.name)
+	}
+	return conn, nil
+}
+
+func (s *recordingSecurity) SecureInbound(ctx context.Context, insecure net.Conn) (sec.SecureConn, error) {
+	return s.record(s.SecureTransport.SecureInbound(ctx, insecure))
+}
+
+func (s *recordingSecurity) SecureOutbound(ctx context.Context, insecure net.Conn, p peer.ID) (sec.SecureConn, error) {
+	return s.record(s.SecureTransport.SecureOutbound(ctx, insecure, p))
+}
+
+func isRelayed(conn network.Conn) bool {
+	_, err := conn.RemoteMultiaddr().ValueForProtocol(ma.P_CIRCUIT)
+	return err == nil
+}
+
+func transportName(addr ma.Multiaddr) string {
+	for _, proto := range []struct {
+		code int
+		name string
+	}{{ma.P_CIRCUIT, "relay"}, {ma.P_QUIC, "quic"}, {ma.P_WS, "websocket"}, {ma.P_TCP, "tcp"}, {ma.P_UDP, "udp"}} {
+		if _, err := addr.ValueForProtocol(proto.code); err == nil {return proto.name}
+	}
+	return "unknown"
+}
+
+func securityName(conn network.Conn) string {
+	if name, ok := connSecurity.Load(connKey(conn.RemotePeer(), conn.RemoteMultiaddr())); ok {return name.(string)}
+	if _, err := conn.RemoteMultiaddr().ValueForProtocol(ma.P_QUIC); err == nil {return "tls"} // QUIC always uses TLS 1.3
+	return "unknown"
+}
+
+// streamConn returns the libp2p connection under a stream, if there is one
+func streamConn(stream twoWayStream) network.Conn {
+	switch s := stream.(type) {
+	case network.Stream:
+		return s.Conn()
+	case *fanOutEndpoint:
+		return s.fan.stream.Conn()
+	}
+	return nil
+}
+
+func connectionStatus(con *libp2pConnection, directAddr string) *smsgConnectionStatusParams {
+	conn := streamConn(con.stream)
+	if conn == nil {return nil}
+	return &smsgConnectionStatusParams{
+		strconv.FormatUint(con.id, 10),
+		con.peerID.Pretty(),
+		conn.RemoteMultiaddr().String(),
+		transportName(conn.RemoteMultiaddr()),
+		conn.Stat().Direction.String(),
+		securityName(conn),
+		isRelayed(conn),
+		directAddr,
+	}
+}
+
+func (c *libp2pClient) sendConnectionStatus(con *libp2pConnection) {
+	if status := connectionStatus(con, ""); status != nil {
+		c.writeMsgpack(status)
+	}
+}
+
+// watchConnections tells clients when a peer with relayed streams becomes directly connected
+func (r *libp2pRelay) watchConnections() {
+	r.host.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(n network.Network, conn network.Conn) {
+			if isRelayed(conn) {return}
+			peerID := conn.RemotePeer()
+			directAddr := conn.RemoteMultiaddr().String()
+			svc(r, func() {
+				for _, cl := range r.clients {
+					c := getLibp2pClient(cl)
+					svc(c, func() {
+						for _, con := range c.connectionsTo(peerID) {
+							if pconn := streamConn(con.stream); pconn != nil && isRelayed(pconn) {
+								fmt.Printf("DIRECT CONNECTION TO %s AVAILABLE FOR RELAYED CONNECTION %d\n", peerID.Pretty(), con.id)
+								c.writeMsgpack(connectionStatus(con, directAddr))
+							}
+						}
+					})
+				}
+			})
+		},
+		DisconnectedF: func(n network.Network, conn network.Conn) {
+			connSecurity.Delete(connKey(conn.RemotePeer(), conn.RemoteMultiaddr()))
+		},
+	})
+}
+
+func (c *libp2pClient) connectionsTo(peerID peer.ID) []*libp2pConnection {
+	var cons []*libp2pConnection
+	for _, con := range c.forwarders {
+		if con.peerID == peerID {
+			cons = append(cons, con)
+		}
+	}
+	for _, lis := range c.listeners {
+		for _, con := range lis.connections {
+			if con.peerID == peerID {
+				cons = append(cons, con)
+			}
+		}
+	}
+	return cons
+}
@@ -0,0 +1,161 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+/*
+# FAKE NAT
+
+-fakenat SPEC simulates a NAT gateway. SPEC is a comma separated list of settings:
+
+```
+  missing       -- no gateway is discovered
+  ip=IP         -- the external address, 203.0.113.1 by default
+  ipchange=D    -- the external address changes every D
+  leasefail=N   -- every Nth mapping request fails
+  lose=D        -- the gateway forgets its mappings D after starting and maps them to new ports
+  outage=D      -- after losing its mappings, the gateway refuses requests for D
+```
+
+For example, -fakenat lose=1m,outage=30s loses the mapping a minute in, long enough for the
+relay to report itself private, then restores it on a different port.
+*/
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	nat "github.com/libp2p/go-nat"
+)
+
+type fakeNAT struct {
+	lock       sync.Mutex
+	missing    bool
+	externalIP net.IP
+	ipChange   time.Duration
+	leaseFail  int
+	lose       time.Duration
+	outage     time.Duration
+	start      time.Time
+	lostAt     time.Time
+	lost       bool
+	requests   int
+	mappings   map[string]int // "protocol port" -> external port
+	nextPort   int
+}
+
+var fakeNATSpec = ""
+
+func parseFakeNAT(spec string) (*fakeNAT, error) {
+	f := &fakeNAT{
+		externalIP: net.IPv4(203, 0, 113, 1),
+		mappings:   make(map[string]int),
+		nextPort:   40000,
+	}
+	for _, setting := range strings.Split(spec, ",") {
+		var err error
+		name, value := setting, ""
+		if i := strings.IndexByte(setting, '='); i != -1 {
+			name, value = setting[:i], setting[i+1:]
+		}
+		switch name {
+		case "missing":
+			f.missing = true
+		case "ip":
+			f.externalIP = net.ParseIP(value).To4()
+			if f.externalIP == nil {err = fmt.Errorf("bad IPv4 address")}
+		case "ipchange":
+			f.ipChange, err = time.ParseDuration(value)
+		case "leasefail":
+			f.leaseFail, err = strconv.Atoi(value)
+		case "lose":
+			f.lose, err = time.ParseDuration(value)
+		case "outage":
+			f.outage, err = time.ParseDuration(value)
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+		if err != nil {return nil, fmt.Errorf("bad fake NAT setting %q: %w", setting, err)}
+	}
+	return f, nil
+}
+
+func (f *fakeNAT) discover(ctx context.Context, timeout time.Duration) (nat.NAT, error) {
+	if f.missing {return nil, nat.ErrNoNATFound}
+	f.start = time.Now()
+	fmt.Println("USING FAKE NAT")
+	return f, nil
+}
+
+func (f *fakeNAT) Type() string {
+	return "fake"
+}
+
+func (f *fakeNAT) GetDeviceAddress() (net.IP, error) {
+	return net.IPv4(192, 168, 1, 1), nil
+}
+
+func (f *fakeNAT) GetInternalAddress() (net.IP, error) {
+	return net.IPv4(192, 168, 1, 2), nil
+}
+
+func (f *fakeNAT) GetExternalAddress() (net.IP, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ip := append(net.IP{}, f.externalIP...)
+	if f.ipChange > 0 {
+		ip[3] += byte(time.Since(f.start) / f.ipChange)
+	}
+	return ip, nil
+}
+
+func (f *fakeNAT) AddPortMapping(protocol string, internalPort int, description string, timeout time.Duration) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests++
+	if f.leaseFail > 0 && f.requests%f.leaseFail == 0 {return 0, fmt.Errorf("fake lease failure")}
+	if f.lose > 0 && !f.lost && time.Since(f.start) >= f.lose {
+		f.lost = true
+		f.lostAt = time.Now()
+		f.mappings = make(map[string]int)
+	}
+	if f.lost && time.Since(f.lostAt) < f.outage {return 0, fmt.Errorf("fake NAT outage")}
+	key := protocol + " " + strconv.Itoa(internalPort)
+	if port, ok := f.mappings[key]; ok {return port, nil}
+	f.mappings[key] = f.nextPort
+	f.nextPort++
+	return f.mappings[key], nil
+}
+
+func (f *fakeNAT) DeletePortMapping(protocol string, internalPort int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.mappings, protocol+" "+strconv.Itoa(internalPort))
+	return nil
+}
@@ -0,0 +1,320 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+/*
+# FRIEND RELAY
+
+With -relayfriends, this peer relays circuits for friends behind NAT while its own NAT status is
+public. go-libp2p 0.9 only has circuit relay v1, so the v1 hop service is turned on and wrapped
+to add the limits relay v2 would provide. The host's circuit relay is built by this file instead
+of by libp2p.EnableRelay, with a host wrapper that hands the relay's stream handler to the
+friends-only gate:
+
+```
+  -relayfriends          -- relay circuits to and from friends
+  -relayslots N          -- concurrent relayed circuits
+  -relayduration D       -- how long a circuit may stay open
+  -relaydata N           -- bytes a circuit may carry in both directions together
+```
+
+Only circuits with a friend at one end are relayed and only friends are told this peer can hop,
+so other peers' AutoRelay passes it by. While public, it advertises itself at AutoRelay's
+rendezvous so friends can find it. AutoRelay in this go-libp2p version picks among the relays it
+finds at random and has no way to prefer one. Turning on the hop service also turns off this
+peer's own AutoRelay. Clients receive Relay Status when they start and whenever relaying starts
+or stops.
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	circuit "github.com/libp2p/go-libp2p-circuit"
+	pb "github.com/libp2p/go-libp2p-circuit/pb"
+	coredisc "github.com/libp2p/go-libp2p-core/discovery"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/libp2p/go-libp2p-core/transport"
+	discovery "github.com/libp2p/go-libp2p-discovery"
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
+	autorelay "github.com/libp2p/go-libp2p/p2p/host/relay"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const maxCircuitMessage = 4096
+
+var relayFriends = false
+
+var relayLimits = struct {
+	slots    int           // concurrent relayed circuits
+	duration time.Duration // how long a circuit may stay open
+	data     int64         // bytes a circuit may carry
+}{16, 2 * time.Minute, 128 * 1024}
+
+type friendRelay struct {
+	relay       *libp2pRelay
+	handler     network.StreamHandler // the circuit relay's own handler
+	circuits    int32                 // open circuits, use atomic ops
+	public      int32                 // whether the relay's NAT status is public, use atomic ops
+	advertising context.CancelFunc
+}
+
+var hopService *friendRelay
+
+// relayHost keeps the circuit relay's stream handler instead of registering it
+type relayHost struct {
+	host.Host
+	handler network.StreamHandler
+}
+
+func (h *relayHost) SetStreamHandler(pid protocol.ID, handler network.StreamHandler) {
+	h.handler = handler
+}
+
+// friendRelayOptions replace libp2p's circuit relay with one behind the friends-only gate
+func friendRelayOptions() []libp2p.Option {
+	return []libp2p.Option{
+		libp2p.DisableRelay(),
+		libp2p.Transport(newFriendRelayTransport),
+		func(cfg *libp2p.Config) error {
+			cfg.EnableAutoRelay = false // a relay does not use other relays, as with EnableRelay(circuit.OptHop)
+			return nil
+		},
+	}
+}
+
+// newFriendRelayTransport builds the hop-enabled circuit relay and puts the gate in front of it
+func newFriendRelayTransport(h host.Host, upgrader *tptu.Upgrader) (transport.Transport, error) {
+	rh := &relayHost{Host: h}
+	relay, err := circuit.NewRelay(context.Background(), rh, upgrader, circuit.OptHop)
+	if err != nil {return nil, err}
+	hopService = &friendRelay{relay: centralRelay, handler: rh.handler}
+	h.SetStreamHandler(circuit.ProtoID, hopService.handleStream)
+	return relay.Transport(), nil
+}
+
+// initFriendRelay accepts relayed connections, which EnableRelay would otherwise have done
+func initFriendRelay(r *libp2pRelay) error {
+	if err := r.host.Network().Listen(ma.StringCast("/p2p-circuit")); err != nil {return fmt.Errorf("could not listen for relayed connections: %w", err)}
+	fmt.Println("RELAYING FOR FRIENDS")
+	return nil
+}
+
+func writeDelimited(w io.Writer, data []byte) error {
+	size := make([]byte, binary.MaxVarintLen64)
+	_, err := w.Write(size[:binary.PutUvarint(size, uint64(len(data)))])
+	if err != nil {return err}
+	_, err = w.Write(data)
+	return err
+}
+
+// byteReader reads one byte at a time so nothing past the message is consumed
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r, b[:])
+	return b[0], err
+}
+
+func readCircuitMessage(r io.Reader, msg *pb.CircuitRelay) error {
+	size, err := binary.ReadUvarint(byteReader{r})
+	if err != nil {return err}
+	if size > maxCircuitMessage {return fmt.Errorf("circuit message too large: %d", size)}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {return err}
+	return msg.Unmarshal(buf)
+}
+
+func refuseCircuit(s network.Stream, code pb.CircuitRelay_Status) {
+	countRefusal("relay")
+	msg := &pb.CircuitRelay{Type: pb.CircuitRelay_STATUS.Enum(), Code: code.Enum()}
+	data, err := msg.Marshal()
+	if err == nil {
+		err = writeDelimited(s, data)
+	}
+	if err != nil {
+		s.Reset()
+		return
+	}
+	s.Close()
+}
+
+// active returns whether circuits are relayed, stream handlers call it so it does not read the relay's natStatus
+func (f *friendRelay) active() bool {
+	return atomic.LoadInt32(&f.public) != 0
+}
+
+func (f *friendRelay) handleStream(s network.Stream) {
+	var msg pb.CircuitRelay
+	var replay bytes.Buffer
+	if err := readCircuitMessage(io.TeeReader(s, &replay), &msg); err != nil {
+		s.Reset()
+		return
+	}
+	remote := s.Conn().RemotePeer()
+	stream := &circuitStream{Stream: s, reader: io.MultiReader(&replay, s)}
+	switch msg.GetType() {
+	case pb.CircuitRelay_CAN_HOP:
+		if !f.active() || !isFriend(remote) {
+			refuseCircuit(s, pb.CircuitRelay_HOP_CANT_SPEAK_RELAY)
+			return
+		}
+	case pb.CircuitRelay_HOP:
+		dst, err := peer.IDFromBytes(msg.GetDstPeer().GetId())
+		if err != nil {
+			refuseCircuit(s, pb.CircuitRelay_HOP_DST_MULTIADDR_INVALID)
+			return
+		}
+		if !f.active() {
+			refuseCircuit(s, pb.CircuitRelay_HOP_CANT_SPEAK_RELAY)
+			return
+		}
+		if !isFriend(remote) && !isFriend(dst) {
+			fmt.Printf("REFUSED TO RELAY FROM %s TO %s: NEITHER IS A FRIEND\n", remote.Pretty(), dst.Pretty())
+			refuseCircuit(s, pb.CircuitRelay_HOP_CANT_SPEAK_RELAY)
+			return
+		}
+		if atomic.AddInt32(&f.circuits, 1) > int32(relayLimits.slots) {
+			atomic.AddInt32(&f.circuits, -1)
+			fmt.Printf("REFUSED TO RELAY FROM %s TO %s: NO FREE SLOTS\n", remote.Pretty(), dst.Pretty())
+			refuseCircuit(s, pb.CircuitRelay_HOP_CANT_SPEAK_RELAY)
+			return
+		}
+		fmt.Printf("RELAYING FROM %s TO %s\n", remote.Pretty(), dst.Pretty())
+		stream.limit(f)
+	}
+	f.handler(stream)
+}
+
+// circuitStream replays the message read from the stream and enforces the circuit limits. The
+// relay closes the stream when it finishes copying to it while the other direction may still be
+// copying, so the circuit is released when both directions are done or the stream is reset.
+type circuitStream struct {
+	network.Stream
+	reader    io.Reader
+	used      int64 // bytes carried, use atomic ops
+	limits    bool
+	timer     *time.Timer
+	done      sync.Once
+	relay     *friendRelay
+	readDone  int32 // reading hit EOF or an error, use atomic ops
+	writeDone int32 // the relay closed the stream for writing, use atomic ops
+	halves    int32 // directions done, use atomic ops
+}
+
+func (s *circuitStream) limit(f *friendRelay) {
+	s.limits = true
+	s.relay = f
+	s.timer = time.AfterFunc(relayLimits.duration, func() {
+		fmt.Printf("RELAYED CIRCUIT FROM %s TIMED OUT\n", s.Conn().RemotePeer().Pretty())
+		s.Reset()
+	})
+}
+
+func (s *circuitStream) count(n int) {
+	if s.limits && atomic.AddInt64(&s.used, int64(n)) > relayLimits.data {
+		fmt.Printf("RELAYED CIRCUIT FROM %s USED ITS DATA LIMIT\n", s.Conn().RemotePeer().Pretty())
+		s.Reset()
+	}
+}
+
+func (s *circuitStream) release() {
+	if s.limits {
+		s.done.Do(func() {
+			s.timer.Stop()
+			atomic.AddInt32(&s.relay.circuits, -1)
+		})
+	}
+}
+
+// halfDone notes that one direction is done, releasing the circuit after both are
+func (s *circuitStream) halfDone(flag *int32) {
+	if atomic.CompareAndSwapInt32(flag, 0, 1) && atomic.AddInt32(&s.halves, 1) == 2 {
+		s.release()
+	}
+}
+
+func (s *circuitStream) Read(buf []byte) (int, error) {
+	n, err := s.reader.Read(buf)
+	s.count(n)
+	if err != nil {
+		s.halfDone(&s.readDone)
+	}
+	return n, err
+}
+
+func (s *circuitStream) Write(buf []byte) (int, error) {
+	n, err := s.Stream.Write(buf)
+	s.count(n)
+	return n, err
+}
+
+// Close closes the stream for writing
+func (s *circuitStream) Close() error {
+	s.halfDone(&s.writeDone)
+	return s.Stream.Close()
+}
+
+func (s *circuitStream) Reset() error {
+	s.release()
+	return s.Stream.Reset()
+}
+
+// natChanged starts or stops relaying when this peer's NAT status changes
+func (f *friendRelay) natChanged() {
+	r := f.relay
+	public := int32(0)
+	if r.natStatus == network.ReachabilityPublic {
+		public = 1
+	}
+	atomic.StoreInt32(&f.public, public)
+	if f.active() && f.advertising == nil && r.discovery != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		f.advertising = cancel
+		discovery.Advertise(ctx, r.discovery, autorelay.RelayRendezvous, coredisc.TTL(autorelay.AdvertiseTTL))
+	} else if !f.active() && f.advertising != nil {
+		f.advertising()
+		f.advertising = nil
+	}
+	fmt.Println("RELAY STATUS: ACTIVE", f.active())
+	r.broadcast(f.status())
+}
+
+func (f *friendRelay) status() *smsgRelayStatusParams {
+	return &smsgRelayStatusParams{f.active(), relayLimits.slots, int(atomic.LoadInt32(&f.circuits))}
+}
@@ -0,0 +1,192 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	friendsPrefix      = "/libp2p-websocket/friends/"
+	maxFriendAddrs     = 10
+	friendSaveInterval = time.Minute // how stale a stored LastSeen may get before friendSeen saves it
+)
+
+// friendInfo is stored in the datastore as JSON and sent to clients in smsgFriendList
+type friendInfo struct {
+	PeerID   string
+	Nickname string
+	LastSeen int64    // unix milliseconds, 0 if never seen
+	Addrs    []string // most recently seen first
+	Trust    int      // client-defined trust level
+}
+
+var friendsLock sync.Mutex                     // protects conf.friends and friendsSaved
+var friendsSaved = make(map[peer.ID]time.Time) // when friendSeen last saved each friend
+
+func friendKey(peerID peer.ID) datastore.Key {
+	return datastore.NewKey(friendsPrefix + peerID.Pretty())
+}
+
+// initFriends merges stored friends into conf.friends and starts tracking when friends are seen
+func initFriends() {
+	friendsLock.Lock()
+	defer friendsLock.Unlock()
+	if conf.dstor != nil {
+		results, err := conf.dstor.Query(query.Query{Prefix: friendsPrefix})
+		checkErr(err)
+		entries, err := results.Rest()
+		checkErr(err)
+		for _, entry := range entries {
+			info := new(friendInfo)
+			if err := json.Unmarshal(entry.Value, info); err != nil {
+				fmt.Println("BAD FRIEND ENTRY", entry.Key, err)
+				continue
+			}
+			peerID, err := peer.Decode(info.PeerID)
+			if err != nil {continue}
+			conf.friends[peerID] = info
+		}
+		for _, info := range conf.friends {
+			saveFriend(info)
+		}
+	}
+	fmt.Printf("FRIENDS: %d\n", len(conf.friends))
+	for peerID := range conf.friends {
+		protectFriend(peerID)
+	}
+	conf.myHost.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(n network.Network, con network.Conn) {
+			friendSeen(con.RemotePeer(), con.RemoteMultiaddr())
+		},
+	})
+}
+
+// saveFriend must be called with friendsLock held
+func saveFriend(info *friendInfo) {
+	if conf.dstor == nil {return}
+	peerID, err := peer.Decode(info.PeerID)
+	if err != nil {return}
+	value, err := json.Marshal(info)
+	if err == nil {
+		err = conf.dstor.Put(friendKey(peerID), value)
+	}
+	if err != nil {
+		fmt.Println("ERROR SAVING FRIEND", info.PeerID, err)
+	}
+}
+
+// deleteFriend must be called with friendsLock held
+func deleteFriend(peerID peer.ID) {
+	delete(conf.friends, peerID)
+	delete(friendsSaved, peerID)
+	if conf.dstor == nil {return}
+	if err := conf.dstor.Delete(friendKey(peerID)); err != nil {
+		fmt.Println("ERROR DELETING FRIEND", peerID.Pretty(), err)
+	}
+}
+
+func isFriend(peerID peer.ID) bool {
+	friendsLock.Lock()
+	defer friendsLock.Unlock()
+	return conf.friends[peerID] != nil
+}
+
+// friendSeen updates a friend's LastSeen and addresses in memory, saving them only when the address
+// changed or the stored LastSeen is older than friendSaveInterval
+func friendSeen(peerID peer.ID, addr ma.Multiaddr) {
+	friendsLock.Lock()
+	defer friendsLock.Unlock()
+	info := conf.friends[peerID]
+	if info == nil {return}
+	now := time.Now()
+	info.LastSeen = now.UnixNano() / int64(time.Millisecond)
+	addrs := []string{addr.String()}
+	moved := len(info.Addrs) == 0 || info.Addrs[0] != addrs[0]
+	for _, old := range info.Addrs {
+		if old != addrs[0] && len(addrs) < maxFriendAddrs {
+			addrs = append(addrs, old)
+		}
+	}
+	info.Addrs = addrs
+	if moved || now.Sub(friendsSaved[peerID]) >= friendSaveInterval {
+		friendsSaved[peerID] = now
+		saveFriend(info)
+	}
+}
+
+// changeFriends adds and removes friends, returning the ones that actually changed
+func changeFriends(add []peer.ID, remove []peer.ID) ([]peer.ID, []peer.ID) {
+	friendsLock.Lock()
+	defer friendsLock.Unlock()
+	var added, removed []peer.ID
+	for _, peerID := range add {
+		if conf.friends[peerID] == nil {
+			info := &friendInfo{PeerID: peerID.Pretty()}
+			conf.friends[peerID] = info
+			saveFriend(info)
+			protectFriend(peerID)
+			added = append(added, peerID)
+		}
+	}
+	for _, peerID := range remove {
+		if conf.friends[peerID] != nil {
+			deleteFriend(peerID)
+			unprotectFriend(peerID)
+			removed = append(removed, peerID)
+		}
+	}
+	return added, removed
+}
+
+func setFriendInfo(peerID peer.ID, nickname string, trust int) error {
+	friendsLock.Lock()
+	defer friendsLock.Unlock()
+	info := conf.friends[peerID]
+	if info == nil {return fmt.Errorf("%s is not a friend", peerID.Pretty())}
+	info.Nickname = nickname
+	info.Trust = trust
+	saveFriend(info)
+	return nil
+}
+
+func friendInfoList() []friendInfo {
+	friendsLock.Lock()
+	defer friendsLock.Unlock()
+	infos := make([]friendInfo, 0, len(conf.friends))
+	for _, info := range conf.friends {
+		infos = append(infos, *info)
+	}
+	return infos
+}
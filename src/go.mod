@@ -6,27 +6,36 @@ require (
 	github.com/go-errors/errors v1.1.1
 	github.com/gorilla/websocket v1.4.2
 	github.com/hsanjuan/ipfs-lite v1.1.14
+	github.com/ipfs/go-block-format v0.0.2
 	github.com/ipfs/go-cid v0.0.6
 	github.com/ipfs/go-datastore v0.4.4
 	github.com/ipfs/go-ipfs v0.6.0
 	github.com/ipfs/go-ipfs-config v0.8.0
 	github.com/ipfs/go-ipfs-pinner v0.0.4
+	github.com/ipfs/go-ipld-format v0.2.0
 	github.com/ipfs/go-log v1.0.4
 	github.com/ipfs/go-log/v2 v2.1.1
 	github.com/ipfs/go-path v0.0.7
+	github.com/ipld/go-car v0.1.0
 	github.com/libp2p/go-libp2p v0.9.6
 	github.com/libp2p/go-libp2p-autonat v0.2.3
+	github.com/libp2p/go-libp2p-circuit v0.2.3
 	github.com/libp2p/go-libp2p-connmgr v0.2.4
 	github.com/libp2p/go-libp2p-core v0.5.7
 	github.com/libp2p/go-libp2p-discovery v0.4.0
 	github.com/libp2p/go-libp2p-kad-dht v0.8.2
 	github.com/libp2p/go-libp2p-protocol v0.1.0
+	github.com/libp2p/go-libp2p-pubsub v0.3.1
 	github.com/libp2p/go-libp2p-quic-transport v0.6.0
 	github.com/libp2p/go-libp2p-secio v0.2.2
 	github.com/libp2p/go-libp2p-tls v0.1.3
+	github.com/libp2p/go-libp2p-transport-upgrader v0.3.0
 	github.com/libp2p/go-nat v0.0.5
 	github.com/multiformats/go-multiaddr v0.2.2
+	github.com/multiformats/go-multiaddr-net v0.1.5
 	github.com/pkg/browser v0.0.0-20180916011732-0a3d74bf9ce4
+	github.com/prometheus/client_golang v1.6.0
 	github.com/zot/textcraft-packet v0.0.0-20200804200640-d6bd45ea53e0
 	github.com/zot/textcraft-treerequest v0.0.0-20200804201905-7654fff7b633
+	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
 )
@@ -37,6 +37,24 @@
   Data:        [4][ID: 8][data: rest]         -- write data to stream
   Connect:     [5][FRAMES: 1][PROTOCOL: STR][RELAY: STR][PEERID: rest] -- connect to another peer (frames optional)
   Friends:     [6][ADD: []str][REMOVE: []str] -- alter friend list
+  ListFriends: [7]                            -- request the friend list
+  FriendInfo:  [8][PEERID: str][NICKNAME: str][TRUST: int] -- set a friend's nickname and trust level
+  CreateInvite: [9][VALIDFOR: int][ONETIME: 1] -- create a signed invitation valid for VALIDFOR seconds
+  AcceptInvite: [10][INVITE: str]             -- verify an invitation and add the inviter as a friend
+  ListenerACL: [11][PROTOCOL: str][MODE: int][PEERS: []str] -- restrict who may connect to PROTOCOL
+  ListenerResponse: [12][ID: str][ACCEPT: 1]  -- accept or refuse a Listener Request
+  Block:       [13][ADD: []str][REMOVE: []str] -- alter the blocklist of peer IDs, IPs and CIDR ranges
+  ListBlocked: [14]                           -- request the blocklist
+  ListenMode:  [15][PROTOCOL: str][MODE: int] -- route streams for a protocol shared with other clients
+                                                 0: round robin, 1: first responder, 2: fan out
+  Subscribe:   [16][TOPIC: str][FRIENDSONLY: 1] -- receive pubsub messages for TOPIC
+  Unsubscribe: [17][TOPIC: str]               -- stop receiving messages for TOPIC
+  Publish:     [18][TOPIC: str][DATA: rest]   -- publish DATA to TOPIC
+  Advertise:   [19][NAMESPACE: str]           -- advertise this peer under NAMESPACE until stopped
+  StopAdvertising: [20][NAMESPACE: str]       -- stop advertising under NAMESPACE
+  FindPeers:   [21][NAMESPACE: str][LIMIT: int] -- find peers advertising NAMESPACE, 0 for no limit
+  PeerInfo:    [22][PEERID: str]              -- look up and ping a peer, answered with Peer Info
+  ConnectedPeers: [23]                        -- request the live connections to each peer
 ```
 
 # SERVER-TO-CLIENT MESSAGES
@@ -55,6 +73,25 @@
   Listening:               [10][PROTOCOL: rest]                -- confirmation that listening has started
   Access Change:           [11][PUBLIC: 1]                     -- peer access has changed
   Presence Change:         [12][ONLINE: []str][OFFLINE: []str] -- peer access has changed
+  Friend List:             [13][FRIENDS: []{PeerID, Nickname, LastSeen, Addrs, Trust}] -- stored friends
+  Invite:                  [14][INVITE: str]                   -- a signed invitation to this peer
+  Invite Accepted:         [15][PEERID: str][TREENAME: str]    -- the inviter is now a friend
+  Listener Request:        [16][ID: str][PEERID: str][PROTOCOL: str] -- PEERID wants to connect, answer with ListenerResponse
+  Block List:              [17][ENTRIES: []str]                -- blocked peer IDs and IP ranges
+  Limit Exceeded:          [18][PEERID: str][PROTOCOL: str][REASON: str] -- refused a stream from PEERID because of a resource limit
+  Topic Message:           [19][TOPIC: str][PEERID: str][DATA: bytes] -- a pubsub message PEERID published to TOPIC
+  Peer Found:              [20][NAMESPACE: str][PEERID: str][ADDRS: []str] -- FindPeers found a peer
+  Find Peers Done:         [21][NAMESPACE: str]                -- FindPeers finished
+  LAN Peer:                [22][PEERID: str][ADDRS: []str]     -- mDNS found a peer on the local network
+  Peer Info:               [23][PEERID: str][ADDRS: []str][PROTOCOLS: []str][AGENT: str][CONNECTEDNESS: str][RTT: int][ERROR: str]
+                                                               -- answer to PeerInfo, RTT is in microseconds or -1 if ping failed
+  Connection Status:       [24][CONID: str][PEERID: str][ADDR: str][TRANSPORT: str][DIRECTION: str][SECURITY: str][RELAYED: 1][DIRECTADDR: str]
+                                                               -- the libp2p connection under a stream, sent after Peer Connection and
+                                                               -- Listener Connection and again with DIRECTADDR when a relayed peer connects directly
+  Relay Status:            [25][ACTIVE: 1][SLOTS: int][CIRCUITS: int] -- whether this peer is relaying circuits for friends
+  Addresses Changed:       [26][ADDRESSES: []str]              -- this peer's addresses changed
+  Connected Peers:         [27][PEERS: []{PeerID, Connections: []{ConnectionID, Protocol, Client, BytesIn, BytesOut}}]
+                                                               -- answer to ConnectedPeers, Client numbers the owning client
 ```
 */
 "use strict"
@@ -78,6 +115,23 @@ const cmsg = Object.freeze({
     data: 4,
     connect: 5,
     friends: 6,
+    listFriends: 7,
+    friendInfo: 8,
+    createInvite: 9,
+    acceptInvite: 10,
+    listenerACL: 11,
+    listenerResponse: 12,
+    block: 13,
+    listBlocked: 14,
+    listenMode: 15,
+    subscribe: 16,
+    unsubscribe: 17,
+    publish: 18,
+    advertise: 19,
+    stopAdvertising: 20,
+    findPeers: 21,
+    peerInfo: 22,
+    connectedPeers: 23,
 });
 
 const smsg = Object.freeze({
@@ -94,6 +148,21 @@ const smsg = Object.freeze({
     listening: 10,
     accessChange: 11,
     presenceChange: 12,
+    friendList: 13,
+    invite: 14,
+    inviteAccepted: 15,
+    listenerRequest: 16,
+    blockList: 17,
+    limitExceeded: 18,
+    topicMessage: 19,
+    peerFound: 20,
+    findPeersDone: 21,
+    lanPeer: 22,
+    peerInfo: 23,
+    connectionStatus: 24,
+    relayStatus: 25,
+    addressesChanged: 26,
+    connectedPeers: 27,
 });
 
 const errors = Object.freeze({
@@ -104,6 +173,7 @@ const errors = Object.freeze({
 
 var ws;
 var peerID;
+var sessionStorageKey = 'libp2p-websocket-session';
 var utfDecoder = new TextDecoder("utf-8");
 var utfEncoder = new TextEncoder("utf-8");
 
@@ -177,10 +247,116 @@ function friends(add, remove) {
     });
 }
 
+function listFriends() {
+    sendMsg(cmsg.listFriends, {});
+}
+
+function friendInfo(peerID, nickname, trust = 0) {
+    sendMsg(cmsg.friendInfo, {
+        peerID,
+        nickname,
+        trust,
+    });
+}
+
+function createInvite(validFor = 0, oneTime = false) {
+    sendMsg(cmsg.createInvite, {
+        validFor,
+        oneTime,
+    });
+}
+
+function acceptInvite(invite) {
+    sendMsg(cmsg.acceptInvite, { invite });
+}
+
+// access modes for listenerACL
+const aclMode = Object.freeze({
+    open: 0,
+    friends: 1,
+    allow: 2,
+    deny: 3,
+    ask: 4,
+});
+
+// send before listen so no stream is accepted before the ACL is in place
+function listenerACL(protocol, mode, peers = []) {
+    sendMsg(cmsg.listenerACL, {
+        protocol,
+        mode,
+        peers,
+    });
+}
+
+function listenerResponse(conID, accept) {
+    sendMsg(cmsg.listenerResponse, { conID: String(conID), accept });
+}
+
+function block(add, remove = []) {
+    sendMsg(cmsg.block, {
+        add,
+        remove,
+    });
+}
+
+function listBlocked() {
+    sendMsg(cmsg.listBlocked, {});
+}
+
+// routing modes for protocols that several clients listen on
+const listenMode = Object.freeze({
+    roundRobin: 0,
+    firstResponder: 1,
+    fanOut: 2,
+});
+
+function setListenMode(protocol, mode) {
+    sendMsg(cmsg.listenMode, { protocol, mode });
+}
+
+// friendsOnly drops messages from peers who are not friends
+function subscribe(topic, friendsOnly = false) {
+    sendMsg(cmsg.subscribe, { topic, friendsOnly });
+}
+
+function unsubscribe(topic) {
+    sendMsg(cmsg.unsubscribe, { topic });
+}
+
+// data can be a string or a Uint8Array
+function publish(topic, data) {
+    if (typeof data == 'string') {
+        data = utfEncoder.encode(data);
+    }
+    sendMsg(cmsg.publish, { topic, data });
+}
+
+function advertise(namespace) {
+    sendMsg(cmsg.advertise, { namespace });
+}
+
+function stopAdvertising(namespace) {
+    sendMsg(cmsg.stopAdvertising, { namespace });
+}
+
+// results arrive as peerFound messages followed by findPeersDone
+function findPeers(namespace, limit = 0) {
+    sendMsg(cmsg.findPeers, { namespace, limit });
+}
+
+function requestPeerInfo(peerID) {
+    sendMsg(cmsg.peerInfo, { peerID });
+}
+
+// the answer arrives as a connectedPeers message
+function requestConnectedPeers() {
+    sendMsg(cmsg.connectedPeers, {});
+}
+
 // methods mimic the parameter order of the protocol
 class BlankHandler {
     hello(running, thisVersion) { }
-    ident(status, peerID, addresses, peerKey, currentVersion, hasNat) { }
+    ident(status, peerID, addresses, peerKey, currentVersion, hasNat, sessionToken, resumed) { }
     listenerConnection(conID, peerID, prot) { }
     connectionClosed(conID, msg) { }
     data(conID, data, obj) { }  // obj is optionally a JSON object
@@ -192,6 +368,21 @@ class BlankHandler {
     listening(protocol) { }
     accessChange(access) { }
     presenceChange(online, offset) { }
+    friendList(friends) { }
+    invite(invite) { }
+    inviteAccepted(peerID, treeName) { }
+    listenerRequest(conID, peerID, prot) { }
+    blockList(entries) { }
+    limitExceeded(peerID, prot, reason) { }
+    topicMessage(topic, peerID, data) { }
+    peerFound(namespace, peerID, addrs) { }
+    findPeersDone(namespace) { }
+    lanPeer(peerID, addrs) { }
+    peerInfo(peerID, addrs, protocols, agentVersion, connectedness, rtt, error) { }
+    connectionStatus(conID, peerID, addr, transport, direction, security, relayed, directAddr) { }
+    relayStatus(active, slots, circuits) { }
+    addressesChanged(addresses) { }
+    connectedPeers(peers) { }
 }
 
 class DelegatingHandler {
@@ -204,7 +395,7 @@ class DelegatingHandler {
     hello(running, thisVersion) {
         this.tryDelegate('hello', arguments);
     }
-    ident(status, peerID, addresses, peerKey, currentVersion, hasNat) {
+    ident(status, peerID, addresses, peerKey, currentVersion, hasNat, sessionToken, resumed) {
         this.tryDelegate('ident', arguments);
     }
     listenerConnection(conID, peerID, prot) {
@@ -240,6 +431,51 @@ class DelegatingHandler {
     presenceChange(online, offline) {
         this.tryDelegate('presenceChange', arguments);
     }
+    friendList(friends) {
+        this.tryDelegate('friendList', arguments);
+    }
+    invite(invite) {
+        this.tryDelegate('invite', arguments);
+    }
+    inviteAccepted(peerID, treeName) {
+        this.tryDelegate('inviteAccepted', arguments);
+    }
+    listenerRequest(conID, peerID, prot) {
+        this.tryDelegate('listenerRequest', arguments);
+    }
+    blockList(entries) {
+        this.tryDelegate('blockList', arguments);
+    }
+    limitExceeded(peerID, prot, reason) {
+        this.tryDelegate('limitExceeded', arguments);
+    }
+    topicMessage(topic, peerID, data) {
+        this.tryDelegate('topicMessage', arguments);
+    }
+    peerFound(namespace, peerID, addrs) {
+        this.tryDelegate('peerFound', arguments);
+    }
+    findPeersDone(namespace) {
+        this.tryDelegate('findPeersDone', arguments);
+    }
+    lanPeer(peerID, addrs) {
+        this.tryDelegate('lanPeer', arguments);
+    }
+    peerInfo(peerID, addrs, protocols, agentVersion, connectedness, rtt, error) {
+        this.tryDelegate('peerInfo', arguments);
+    }
+    connectionStatus(conID, peerID, addr, transport, direction, security, relayed, directAddr) {
+        this.tryDelegate('connectionStatus', arguments);
+    }
+    relayStatus(active, slots, circuits) {
+        this.tryDelegate('relayStatus', arguments);
+    }
+    addressesChanged(addresses) {
+        this.tryDelegate('addressesChanged', arguments);
+    }
+    connectedPeers(peers) {
+        this.tryDelegate('connectedPeers', arguments);
+    }
     insertDelegatingHandler(hand) {
         hand.delegate = this.delegate;
         this.delegate = hand;
@@ -336,9 +572,9 @@ class LoggingHandler extends DelegatingHandler {
     constructor(delegate) {
         super(delegate);
     }
-    ident(status, peerID, addresses, peerKey, currentVersion, hasNat) {
+    ident(status, peerID, addresses, peerKey, currentVersion, hasNat, sessionToken, resumed) {
         receivedMessageArgs('ident', arguments);
-        super.ident(status, peerID, addresses, peerKey, currentVersion, hasNat);
+        super.ident(status, peerID, addresses, peerKey, currentVersion, hasNat, sessionToken, resumed);
     }
     listenerConnection(conID, peerID, prot) {
         receivedMessageArgs('listenerConnection', arguments);
@@ -384,6 +620,66 @@ class LoggingHandler extends DelegatingHandler {
         receivedMessageArgs('presenceChange', arguments);
         super.accessChange(status)
     }
+    friendList(friends) {
+        receivedMessageArgs('friendList', arguments);
+        super.friendList(friends)
+    }
+    invite(invite) {
+        receivedMessageArgs('invite', arguments);
+        super.invite(invite);
+    }
+    inviteAccepted(peerID, treeName) {
+        receivedMessageArgs('inviteAccepted', arguments);
+        super.inviteAccepted(peerID, treeName);
+    }
+    listenerRequest(conID, peerID, prot) {
+        receivedMessageArgs('listenerRequest', arguments);
+        super.listenerRequest(conID, peerID, prot);
+    }
+    blockList(entries) {
+        receivedMessageArgs('blockList', arguments);
+        super.blockList(entries);
+    }
+    limitExceeded(peerID, prot, reason) {
+        receivedMessageArgs('limitExceeded', arguments);
+        super.limitExceeded(peerID, prot, reason);
+    }
+    topicMessage(topic, peerID, data) {
+        receivedMessageArgs('topicMessage', arguments);
+        super.topicMessage(topic, peerID, data);
+    }
+    peerFound(namespace, peerID, addrs) {
+        receivedMessageArgs('peerFound', arguments);
+        super.peerFound(namespace, peerID, addrs);
+    }
+    findPeersDone(namespace) {
+        receivedMessageArgs('findPeersDone', arguments);
+        super.findPeersDone(namespace);
+    }
+    lanPeer(peerID, addrs) {
+        receivedMessageArgs('lanPeer', arguments);
+        super.lanPeer(peerID, addrs);
+    }
+    peerInfo(peerID, addrs, protocols, agentVersion, connectedness, rtt, error) {
+        receivedMessageArgs('peerInfo', arguments);
+        super.peerInfo(peerID, addrs, protocols, agentVersion, connectedness, rtt, error);
+    }
+    connectionStatus(conID, peerID, addr, transport, direction, security, relayed, directAddr) {
+        receivedMessageArgs('connectionStatus', arguments);
+        super.connectionStatus(conID, peerID, addr, transport, direction, security, relayed, directAddr);
+    }
+    relayStatus(active, slots, circuits) {
+        receivedMessageArgs('relayStatus', arguments);
+        super.relayStatus(active, slots, circuits);
+    }
+    addressesChanged(addresses) {
+        receivedMessageArgs('addressesChanged', arguments);
+        super.addressesChanged(addresses);
+    }
+    connectedPeers(peers) {
+        receivedMessageArgs('connectedPeers', arguments);
+        super.connectedPeers(peers);
+    }
 }
 
 class ConnectionInfo {
@@ -426,11 +722,11 @@ class TrackingHandler extends DelegatingHandler {
         connections.natStatus = natStatus.unknown;
         connections.listeningTo = new Set();
     }
-    ident(status, peerID, addresses, peerKey, currentVersion, hasNat) {
+    ident(status, peerID, addresses, peerKey, currentVersion, hasNat, sessionToken, resumed) {
         this.connections.peerID = peerID;
         this.connections.natStatus = status;
         this.connections.hasNat = hasNat
-        super.ident(status, peerID, addresses, peerKey, currentVersion, hasNat);
+        super.ident(status, peerID, addresses, peerKey, currentVersion, hasNat, sessionToken, resumed);
     }
     listenerConnection(conID, peerID, prot) {
         var con = new ConnectionInfo(conID, peerID, prot, true);
@@ -867,7 +1163,28 @@ function cleanupConnections(connections, conID) {
     connections.infoByConID.delete(conID);
 }
 
-function startProtocol(urlStr, handler) {
+// the session token is kept in sessionStorage so a reloaded page resumes its connections
+function savedSession() {
+    try {
+        return sessionStorage.getItem(sessionStorageKey);
+    } catch (err) {
+        return null;
+    }
+}
+
+function saveSession(token) {
+    try {
+        if (token) sessionStorage.setItem(sessionStorageKey, token);
+    } catch (err) { }
+}
+
+// if resume is true and there is a saved session, ask the relay to resume it
+function startProtocol(urlStr, handler, resume = true) {
+    var token = resume && savedSession();
+
+    if (token) {
+        urlStr += (urlStr.includes('?') ? '&' : '?') + 'session=' + encodeURIComponent(token);
+    }
     ws = new WebSocket(urlStr);
     ws.onopen = function open() {
         console.log("OPENED CONNECTION, WAITING FOR PEER ID AND NAT STATUS...");
@@ -892,7 +1209,8 @@ function startProtocol(urlStr, handler) {
                 handler.hello(msg.started, msg.version);
                 break;
             case smsg.ident:
-                handler.ident(msg.publicPeer ? natStatus.public : natStatus.private, msg.peerID, msg.addresses, msg.peerKey, msg.currentVersion, msg.hasNat);
+                saveSession(msg.sessionToken);
+                handler.ident(msg.publicPeer ? natStatus.public : natStatus.private, msg.peerID, msg.addresses, msg.peerKey, msg.currentVersion, msg.hasNat, msg.sessionToken, msg.resumed);
                 break;
             case smsg.listenerConnection:
                 handler.listenerConnection(BigInt(msg.conID), msg.peerID, msg.protocol);
@@ -932,6 +1250,57 @@ function startProtocol(urlStr, handler) {
                 break;
             case smsg.presenceChange:
                 handler.presenceChange(msg.online, msg.offline);
+                break;
+            case smsg.friendList:
+                handler.friendList(msg.friends);
+                break;
+            case smsg.invite:
+                handler.invite(msg.invite);
+                break;
+            case smsg.inviteAccepted:
+                handler.inviteAccepted(msg.peerID, msg.treeName);
+                break;
+            case smsg.listenerRequest:
+                handler.listenerRequest(BigInt(msg.conID), msg.peerID, msg.protocol);
+                break;
+            case smsg.blockList:
+                handler.blockList(msg.entries);
+                break;
+            case smsg.limitExceeded:
+                handler.limitExceeded(msg.peerID, msg.protocol, msg.reason);
+                break;
+            case smsg.topicMessage:
+                handler.topicMessage(msg.topic, msg.peerID, msg.data);
+                break;
+            case smsg.peerFound:
+                handler.peerFound(msg.namespace, msg.peerID, msg.addrs);
+                break;
+            case smsg.findPeersDone:
+                handler.findPeersDone(msg.namespace);
+                break;
+            case smsg.lanPeer:
+                handler.lanPeer(msg.peerID, msg.addrs);
+                break;
+            case smsg.peerInfo:
+                handler.peerInfo(msg.peerID, msg.addrs, msg.protocols, msg.agentVersion, msg.connectedness, msg.rtt, msg.error);
+                break;
+            case smsg.connectionStatus:
+                handler.connectionStatus(BigInt(msg.conID), msg.peerID, msg.addr, msg.transport, msg.direction, msg.security, msg.relayed, msg.directAddr);
+                break;
+            case smsg.relayStatus:
+                handler.relayStatus(msg.active, msg.slots, msg.circuits);
+                break;
+            case smsg.addressesChanged:
+                handler.addressesChanged(msg.addresses);
+                break;
+            case smsg.connectedPeers:
+                for (const peer of msg.peers || []) {
+                    for (const con of peer.Connections || []) {
+                        con.ConnectionID = BigInt(con.ConnectionID);
+                    }
+                }
+                handler.connectedPeers(msg.peers || []);
+                break;
             default:
                 alert(`Unknown message type ${data[0]}`)
                 break;
@@ -1012,6 +1381,25 @@ export default {
     stop,
     listen,
     connect,
+    listFriends,
+    friendInfo,
+    createInvite,
+    acceptInvite,
+    aclMode,
+    listenerACL,
+    listenerResponse,
+    block,
+    listBlocked,
+    listenMode,
+    setListenMode,
+    subscribe,
+    unsubscribe,
+    publish,
+    advertise,
+    stopAdvertising,
+    findPeers,
+    requestPeerInfo,
+    requestConnectedPeers,
     getString,
     close,
     connectionError,
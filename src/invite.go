@@ -0,0 +1,230 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+/*
+# INVITATIONS
+
+An invitation is a signed version of the /addrs/ peer encoding:
+
+`/invite/BASE85JSON` where BASE85JSON is a JSON object encoded in base85:
+
+```json
+{
+    "Body": BASE64(JSON of {"PeerID", "Addrs", "Expires", "Token", "TreeName"}),
+    "PublicKey": BASE64(inviter's marshalled public key),
+    "Signature": BASE64(signature of Body with the inviter's private key)
+}
+```
+
+The public key must match PeerID and the signature must verify before an invitation is used.
+Expires is in unix seconds.
+
+An invitation with a Token can only be used once. The inviter stores the tokens it issues until
+they expire. The invitee presents the token to the inviter over the invite protocol before it
+accepts the invitation or connects with it, and the inviter consumes the token, so a forwarded
+copy of the invitation is refused by the inviter whoever tries to use it.
+*/
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/ascii85"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	invitePrefix          = "/invite/"
+	issuedInvitesPrefix   = "/libp2p-websocket/invites/issued/"
+	inviteProtocol        = "/libp2p-websocket/invite/1.0.0"
+	defaultInviteDuration = 24 * time.Hour
+	inviteTokenTimeout    = 30 * time.Second
+	maxInviteReply        = 1024
+	inviteAccepted        = "ok"
+)
+
+type inviteBody struct {
+	PeerID   string
+	Addrs    []string
+	Expires  int64  // unix seconds
+	Token    string // optional one-time token
+	TreeName string
+}
+
+type signedInvite struct {
+	Body      []byte
+	PublicKey []byte
+	Signature []byte
+}
+
+var inviteTokensLock sync.Mutex                 // makes redeeming a token atomic
+var issuedInviteTokens = make(map[string]int64) // token -> expiry, used when there is no datastore
+
+// createInvite signs an invitation to this peer that is valid for duration
+func createInvite(addrs []string, duration time.Duration, oneTime bool) (string, error) {
+	if duration <= 0 {
+		duration = defaultInviteDuration
+	}
+	body := inviteBody{
+		PeerID:   conf.myHost.ID().Pretty(),
+		Addrs:    addrs,
+		Expires:  time.Now().Add(duration).Unix(),
+		TreeName: conf.treeName,
+	}
+	if oneTime {
+		token := make([]byte, 16)
+		if _, err := rand.Read(token); err != nil {return "", err}
+		body.Token = hex.EncodeToString(token)
+		if err := issueInviteToken(body.Token, body.Expires); err != nil {return "", err}
+	}
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {return "", err}
+	sig, err := conf.peerKey.Sign(bodyBytes)
+	if err != nil {return "", err}
+	pubBytes, err := crypto.MarshalPublicKey(conf.peerKey.GetPublic())
+	if err != nil {return "", err}
+	inviteBytes, err := json.Marshal(signedInvite{bodyBytes, pubBytes, sig})
+	if err != nil {return "", err}
+	enc := make([]byte, ascii85.MaxEncodedLen(len(inviteBytes)))
+	n := ascii85.Encode(enc, inviteBytes)
+	return invitePrefix + string(enc[:n]), nil
+}
+
+// decodeInvite verifies an invitation and returns its contents and the inviter's address info
+func decodeInvite(invite string) (*inviteBody, *peer.AddrInfo, error) {
+	enc := strings.TrimPrefix(invite, invitePrefix)
+	dst := make([]byte, len(enc))
+	ndst, _, err := ascii85.Decode(dst, []byte(enc), true)
+	if err != nil {return nil, nil, fmt.Errorf("could not decode invitation: %w", err)}
+	signed := new(signedInvite)
+	if err := json.Unmarshal(dst[:ndst], signed); err != nil {return nil, nil, fmt.Errorf("could not decode invitation: %w", err)}
+	pub, err := crypto.UnmarshalPublicKey(signed.PublicKey)
+	if err != nil {return nil, nil, fmt.Errorf("bad public key in invitation: %w", err)}
+	ok, err := pub.Verify(signed.Body, signed.Signature)
+	if err != nil || !ok {return nil, nil, fmt.Errorf("invitation signature is not valid")}
+	body := new(inviteBody)
+	if err := json.Unmarshal(signed.Body, body); err != nil {return nil, nil, fmt.Errorf("could not decode invitation: %w", err)}
+	pid, err := peer.Decode(body.PeerID)
+	if err != nil {return nil, nil, fmt.Errorf("bad peer id in invitation: %s", body.PeerID)}
+	if !pid.MatchesPublicKey(pub) {return nil, nil, fmt.Errorf("invitation was not signed by %s", body.PeerID)}
+	if time.Now().Unix() > body.Expires {return nil, nil, fmt.Errorf("invitation from %s has expired", body.PeerID)}
+	addrInfo := &peer.AddrInfo{ID: pid}
+	for _, addr := range body.Addrs {
+		maddr, err := ma.NewMultiaddr(addr)
+		if err != nil {return nil, nil, fmt.Errorf("bad address in invitation: %s", addr)}
+		addrInfo.Addrs = append(addrInfo.Addrs, maddr)
+	}
+	return body, addrInfo, nil
+}
+
+// issueInviteToken remembers a one-time token until it expires
+func issueInviteToken(token string, expires int64) error {
+	inviteTokensLock.Lock()
+	defer inviteTokensLock.Unlock()
+	if conf.dstor == nil {
+		issuedInviteTokens[token] = expires
+		return nil
+	}
+	return conf.dstor.Put(datastore.NewKey(issuedInvitesPrefix+token), []byte(strconv.FormatInt(expires, 10)))
+}
+
+// redeemInviteToken consumes a token this peer issued, failing if it is unknown, used or expired
+func redeemInviteToken(token string) error {
+	inviteTokensLock.Lock()
+	defer inviteTokensLock.Unlock()
+	var expires int64
+	if conf.dstor == nil {
+		var ok bool
+		expires, ok = issuedInviteTokens[token]
+		if !ok {return fmt.Errorf("invitation is unknown or has already been used")}
+		delete(issuedInviteTokens, token)
+	} else {
+		key := datastore.NewKey(issuedInvitesPrefix + token)
+		value, err := conf.dstor.Get(key)
+		if err == datastore.ErrNotFound {return fmt.Errorf("invitation is unknown or has already been used")}
+		if err != nil {return err}
+		if err := conf.dstor.Delete(key); err != nil {return err}
+		expires, _ = strconv.ParseInt(string(value), 10, 64)
+	}
+	if time.Now().Unix() > expires {return fmt.Errorf("invitation has expired")}
+	return nil
+}
+
+// handleInviteStream redeems the token an invitee presents and answers with inviteAccepted or
+// an error message
+func handleInviteStream(s network.Stream) {
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(inviteTokenTimeout))
+	token, err := ioutil.ReadAll(io.LimitReader(s, maxInviteReply))
+	if err == nil {
+		err = redeemInviteToken(string(token))
+	}
+	if err != nil {
+		fmt.Printf("REFUSED INVITATION TOKEN FROM %s: %v\n", s.Conn().RemotePeer().Pretty(), err)
+		s.Write([]byte(err.Error()))
+		return
+	}
+	fmt.Println("REDEEMED INVITATION TOKEN FROM", s.Conn().RemotePeer().Pretty())
+	s.Write([]byte(inviteAccepted))
+}
+
+// presentInviteToken asks the inviter to consume a one-time token, failing if it refuses
+func presentInviteToken(ctx context.Context, h host.Host, inviter peer.ID, token string) error {
+	if token == "" {return nil}
+	ctx, cancel := context.WithTimeout(ctx, inviteTokenTimeout)
+	defer cancel()
+	s, err := h.NewStream(ctx, inviter, inviteProtocol)
+	if err != nil {return fmt.Errorf("could not present invitation to %s: %w", inviter.Pretty(), err)}
+	s.SetDeadline(time.Now().Add(inviteTokenTimeout))
+	_, err = s.Write([]byte(token))
+	if err == nil {
+		err = s.Close() // closes for writing so the inviter sees the whole token
+	}
+	var reply []byte
+	if err == nil {
+		reply, err = ioutil.ReadAll(io.LimitReader(s, maxInviteReply))
+	}
+	if err != nil {
+		s.Reset()
+		return fmt.Errorf("could not present invitation to %s: %w", inviter.Pretty(), err)
+	}
+	if string(reply) != inviteAccepted {return fmt.Errorf("%s refused the invitation: %s", inviter.Pretty(), reply)}
+	return nil
+}
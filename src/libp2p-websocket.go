@@ -60,7 +60,6 @@ import (
 	ipfspath "github.com/ipfs/go-path"
 	"github.com/libp2p/go-libp2p"
 	autonat "github.com/libp2p/go-libp2p-autonat"
-	connmgr "github.com/libp2p/go-libp2p-connmgr"
 	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
@@ -69,11 +68,8 @@ import (
 	dualdht "github.com/libp2p/go-libp2p-kad-dht/dual"
 	protocol "github.com/libp2p/go-libp2p-protocol"
 	libp2pquic "github.com/libp2p/go-libp2p-quic-transport"
-	secio "github.com/libp2p/go-libp2p-secio"
-	libp2ptls "github.com/libp2p/go-libp2p-tls"
-	nat "github.com/libp2p/go-nat"
 
-	//pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	//pb "github.com/libp2p/go-libp2p-pubsub/pb"
 
 	ma "github.com/multiformats/go-multiaddr"
@@ -86,7 +82,9 @@ import (
 	//autonatSvc "github.com/libp2p/go-libp2p-autonat-svc"
 
 	"github.com/pkg/browser"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	treerequest "github.com/zot/textcraft-treerequest"
+	"golang.org/x/time/rate"
 )
 
 /*
@@ -108,8 +106,9 @@ type libp2pRelay struct {
 	host            host.Host
 	discovery       *discovery.RoutingDiscovery
 	natStatus       network.Reachability
-	natActions      []func()                      // defer these until nat status known
-	connectedPeers  map[peer.ID]*libp2pConnection // connected peers
+	observedStatus  network.Reachability                       // last status checked, natStatus never becomes unknown
+	natActions      []func()                                   // defer these until nat status known
+	connectedPeers  map[peer.ID]map[*libp2pConnection]struct{} // live connections to each peer
 	externalAddress string
 }
 
@@ -118,16 +117,26 @@ type libp2pClient struct {
 	listeners           map[string]*listener         // protocol -> listener
 	listenerConnections map[uint64]*listener         // connectionID -> listener
 	forwarders          map[uint64]*libp2pConnection // connectionID -> forwarder
+	acls                map[string]*listenerACL      // protocol -> listener access control
+	streamCount         int32                        // streams counted against limits, use atomic ops
+	bandwidth           *rate.Limiter
+	subscriptions       map[string]*pubsub.Subscription // topic -> subscription
+	advertisements      map[string]context.CancelFunc   // namespace -> stop advertising
+	ctx                 context.Context                 // canceled when the client closes
+	cancel              context.CancelFunc
 }
 
 type libp2pConnection struct {
 	connection
-	peerID peer.ID
+	peerID     peer.ID
+	released   sync.Once // release the stream's limits only once
+	protectTag string    // connection manager tag protecting the peer while this is open
 }
 
 type listener struct {
 	client         *libp2pClient                // the client that owns this listener
 	connections    map[uint64]*libp2pConnection // connectionID -> connection
+	pending        map[uint64]*streamOffer      // connectionID -> stream waiting for the client to accept it
 	protocol       string
 	frames         bool        // whether to transmit frame lengths
 	managementChan chan func() // client management
@@ -143,8 +152,8 @@ var publishTree cid.Cid
 var hasNat = true
 var customNatTraversal = true
 var publicAddress atomic.Value // ma.Multiaddr
+var publicUDPPort int32         // mapped port for QUIC, 0 if unmapped, use atomic ops
 var test = ""
-var decodeHash = ""
 var p2pPort = 0
 var useIPFSLite = true
 var configDir = ""
@@ -162,6 +171,9 @@ var peerKeyString string
 var listenAddresses addrList
 var fakeNatStatus string
 var bootstrapPeers addrList
+var commandTreeProtocol = ""
+var commandTreeName = ""
+var treeReady = make(chan struct{}) // closed when the tree request service is initialized
 var bootstrapPeerStrings = []string{
 	"/dnsaddr/bootstrap.libp2p.io/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
 	"/dnsaddr/bootstrap.libp2p.io/p2p/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
@@ -185,9 +197,10 @@ var conf struct {
 	dht       *dualdht.DHT
 	publisher *namesys.IpnsPublisher
 	peerKey   crypto.PrivKey
-	friends   map[peer.ID]bool
+	friends   map[peer.ID]*friendInfo
 	treeName  string
 	pin       pinner.Pinner
+	pubsub    *pubsub.PubSub
 }
 var peerFinder interface {
 	FindPeer(context.Context, peer.ID) (peer.AddrInfo, error)
@@ -208,7 +221,8 @@ func createLibp2pRelay() *libp2pRelay {
 		log.Fatal("libp2pRelay does not support protocolHandler interface!")
 	}
 	r.init(r)
-	r.connectedPeers = make(map[peer.ID]*libp2pConnection)
+	r.connectedPeers = make(map[peer.ID]map[*libp2pConnection]struct{})
+	setNATStatusMetric(r.natStatus)
 	return r
 }
 
@@ -236,10 +250,22 @@ func (r *libp2pRelay) CreateClient() *client {
 	c.listeners = make(map[string]*listener)
 	c.listenerConnections = make(map[uint64]*listener)
 	c.forwarders = make(map[uint64]*libp2pConnection)
+	c.acls = make(map[string]*listenerACL)
+	c.subscriptions = make(map[string]*pubsub.Subscription)
+	c.advertisements = make(map[string]context.CancelFunc)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.bandwidth = bandwidthLimiter(limits.clientBandwidth)
 	return &c.client
 }
 
-func (r *libp2pRelay) CleanupClosed(con *connection) {}
+func (r *libp2pRelay) CleanupClosed(con *connection) {
+	lcon := getLibp2pConnection(con)
+	lcon.released.Do(func() {
+		getLibp2pClient(con.client).releaseStream(lcon.peerID)
+		lcon.unprotect()
+		svc(r, func() { r.removeConnectedPeer(lcon) })
+	})
+}
 
 // CloseClient API METHOD
 func (r *libp2pRelay) CloseClient(c *client) {
@@ -253,28 +279,93 @@ func (r *libp2pRelay) CloseClient(c *client) {
 // LISTEN API METHOD
 func (r *libp2pRelay) Listen(cl *client, prot string, frames bool) {
 	c := r.libp2pClient(cl)
+	if c.listeners[prot] != nil {
+		c.writeMsgpack(&smsgListenRefusedParams{prot, "already listening to " + prot})
+		return
+	}
 	lis := c.createListener(prot, frames)
-	for _, currentProt := range r.host.Mux().Protocols() {
-		if currentProt == prot {
-			c.writeMsgpack(&smsgListenRefusedParams{prot, "already listening to " + prot})
-			return
-		}
+	if err := r.joinListenerGroup(lis); err != nil {
+		delete(c.listeners, prot)
+		c.writeMsgpack(&smsgListenRefusedParams{prot, err.Error()})
+		return
 	}
+	metricListeners.WithLabelValues(protocolLabel(prot)).Inc()
 	fmt.Println("listen, protocol: ", prot, ", frames: ", frames)
-	r.host.SetStreamHandler(protocol.ID(prot), func(stream network.Stream) {
-		fmt.Println("GOT A CONNECTION")
-		svc(c, func() {
-			con := c.createConnection(c.newConnectionID(), prot, stream, frames)
-			fmt.Printf("GOT DIRECT CONNECTION ON %s FROM %s\n", prot, stream.Conn().RemotePeer().Pretty())
-			lis.connections[con.id] = con
-			c.listenerConnections[con.id] = lis
-			c.writeMsgpack(&smsgListenerConnectionParams{strconv.FormatUint(con.id, 10), stream.Conn().RemotePeer().Pretty(), prot})
-			c.read(&con.connection)
-		})
-	})
 	c.writeMsgpack(&smsgListeningParams{prot})
 }
 
+// SUBSCRIBE API METHOD
+func (r *libp2pRelay) Subscribe(c *client, topic string, friendsOnly bool) error {
+	return r.libp2pClient(c).subscribe(topic, friendsOnly)
+}
+
+// UNSUBSCRIBE API METHOD
+func (r *libp2pRelay) Unsubscribe(c *client, topic string) {
+	r.libp2pClient(c).unsubscribe(topic)
+}
+
+// PUBLISH API METHOD
+func (r *libp2pRelay) Publish(c *client, topic string, data []byte) error {
+	return publish(topic, data)
+}
+
+// ADVERTISE API METHOD
+func (r *libp2pRelay) Advertise(c *client, namespace string) error {
+	return r.libp2pClient(c).advertise(namespace)
+}
+
+// STOP ADVERTISING API METHOD
+func (r *libp2pRelay) StopAdvertising(c *client, namespace string) {
+	r.libp2pClient(c).stopAdvertising(namespace)
+}
+
+// FIND PEERS API METHOD
+func (r *libp2pRelay) FindPeers(c *client, namespace string, limit int) error {
+	return r.libp2pClient(c).findPeers(namespace, limit)
+}
+
+// PEER INFO API METHOD
+func (r *libp2pRelay) PeerInfo(c *client, peerID string) error {
+	return r.libp2pClient(c).peerInfo(peerID)
+}
+
+// LISTEN MODE API METHOD
+func (r *libp2pRelay) ListenMode(cl *client, prot string, mode int) error {
+	if r.libp2pClient(cl).listeners[prot] == nil {return fmt.Errorf("not listening to %s", prot)}
+	return setListenerGroupMode(prot, mode)
+}
+
+// LISTENER ACL API METHOD
+func (r *libp2pRelay) ListenerACL(cl *client, prot string, mode int, peers []string) error {
+	acl, err := createListenerACL(mode, peers)
+	if err != nil {return err}
+	r.libp2pClient(cl).acls[prot] = acl
+	return nil
+}
+
+// LISTENER RESPONSE API METHOD
+func (r *libp2pRelay) ListenerResponse(cl *client, conID uint64, accept bool) {
+	c := r.libp2pClient(cl)
+	for _, lis := range c.listeners {
+		if offer := lis.pending[conID]; offer != nil {
+			delete(lis.pending, conID)
+			remotePeer := offer.stream.Conn().RemotePeer()
+			if !accept {
+				fmt.Printf("CLIENT REFUSED CONNECTION ON %s FROM %s\n", lis.protocol, remotePeer.Pretty())
+				countRefusal("client")
+				c.refuseOffer(offer)
+			} else if offer.take() {
+				c.acceptListenerConnection(lis, conID, remotePeer, offer.stream)
+			} else {
+				c.releaseStream(remotePeer)
+				c.writeMsgpack(&smsgConnectionClosedParams{strconv.FormatUint(conID, 10), "accepted by another client"})
+			}
+			return
+		}
+	}
+	c.writeMsgpack(&smsgConnectionClosedParams{strconv.FormatUint(conID, 10), "unknown connection request"})
+}
+
 // STOP LISTENER API METHOD
 func (r *libp2pRelay) Stop(c *client, protocol string, retainConnections bool) {
 	lc := getLibp2pClient(c)
@@ -295,12 +386,12 @@ func (r *libp2pRelay) Started() bool {
 func (r *libp2pRelay) Start(treeProtocol string, treeName string, port uint16, pk string, friends []string) error {
 	var err error
 	peerKeyString = pk
-	conf.friends = make(map[peer.ID]bool)
+	conf.friends = make(map[peer.ID]*friendInfo)
 	conf.treeName = treeName
 	for _, friend := range friends {
 		friendPeer, err := peer.Decode(friend)
 		if err != nil {return fmt.Errorf("error decoding peerID %s: %w", friend, err)}
-		conf.friends[friendPeer] = true
+		conf.friends[friendPeer] = &friendInfo{PeerID: friendPeer.Pretty()}
 	}
 	fmt.Println("STARTING RELAY...")
 	if port != 0 {
@@ -308,9 +399,12 @@ func (r *libp2pRelay) Start(treeProtocol string, treeName string, port uint16, p
 	} else {
 		p2pPort = 4005
 	}
+	// IPv6 addresses are usually global, so they are advertised as they are instead of mapped
 	addrs, err := stringsToAddrs([]string{
 		fmt.Sprintf("/ip4/0.0.0.0/udp/%d/quic", p2pPort),
 		fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", p2pPort),
+		fmt.Sprintf("/ip6/::/udp/%d/quic", p2pPort),
+		fmt.Sprintf("/ip6/::/tcp/%d", p2pPort),
 	})
 	if err != nil {return err}
 	listenAddresses = addrs
@@ -340,6 +434,9 @@ func (r *libp2pRelay) StartClient(c *client, init func(public bool, hasNat bool)
 				public = false
 			}
 			init(public, hasNat)
+			if hopService != nil {
+				c.writeMsgpack(hopService.status())
+			}
 		})
 	}()
 }
@@ -393,6 +490,7 @@ func (r *libp2pRelay) Connect(c *client, prot string, peerid string, frames bool
 	//var encodedAddrs addrs
 	encodedAddrs := new(addrs)
 	var addrInfo peer.AddrInfo
+	var invite *inviteBody // accepted once connected, unless the inviter is already a friend
 	relayMsg := "out"
 
 	if relay {
@@ -425,6 +523,17 @@ func (r *libp2pRelay) Connect(c *client, prot string, peerid string, frames bool
 			}
 			addrInfo.Addrs[i] = ma
 		}
+	} else if strings.HasPrefix(peerid, invitePrefix) {
+		body, inviteInfo, err := decodeInvite(peerid)
+		if err != nil {
+			c.connectionRefused(err, peerid, prot)
+			return
+		}
+		peerid = body.PeerID
+		encodedAddrs.PeerID = body.PeerID
+		addrInfo.Addrs = inviteInfo.Addrs
+		invite = body
+		fmt.Println("Invited by peer ID:", peerid)
 	}
 	pid, err := peer.Decode(peerid)
 	if err != nil {
@@ -442,28 +551,44 @@ func (r *libp2pRelay) Connect(c *client, prot string, peerid string, frames bool
 		addrInfo.ID = pid
 		addrInfo.Addrs = []ma.Multiaddr{maddr}
 	}
+	if lan := lanAddrs(pid); len(lan) > 0 {
+		addrInfo.Addrs = append(append([]ma.Multiaddr{}, lan...), addrInfo.Addrs...)
+	}
 	err = r.host.Connect(context.Background(), addrInfo)
 	if err != nil {
 		c.connectionRefused(fmt.Errorf("could not connect to peer %s: %s", pid.Pretty(), err.Error()), pid.Pretty(), prot)
 		return
 	}
+	if invite != nil && !isFriend(pid) {
+		if err := presentInviteToken(context.Background(), r.host, pid, invite.Token); err != nil {
+			c.connectionRefused(err, pid.Pretty(), prot)
+			return
+		}
+		r.inviteAccepted(c, pid, invite)
+	}
 	fmt.Printf("Attempting to connect with protocol %v to peer %v with%s relay\n", prot, peerid, relayMsg)
 	if !relay {
-
+		lc := r.libp2pClient(c)
+		if err := lc.reserveStream(pid); err != nil {
+			c.connectionRefused(err, peerid, prot)
+			return
+		}
 		stream, err := r.host.NewStream(context.Background(), pid, protocol.ID(prot))
 		if err != nil {
 			fmt.Println("COULDN'T OPEN STREAM,", err)
+			lc.releaseStream(pid)
 			c.connectionRefused(err, peerid, prot)
 			return
 		}
 		fmt.Println("Connected")
-		lc := r.libp2pClient(c)
 		//c.newConnection(smsgPeerConnection, prot, stream.Conn().RemotePeer().Pretty(), func(conID uint64) *connection {
+		var con *libp2pConnection
 		c.newConnection(prot, stream.Conn().RemotePeer().Pretty(), func(conID uint64) *connection {
-			con := lc.createConnection(conID, prot, stream, frames)
+			con = lc.createConnection(conID, prot, pid, stream, frames)
 			lc.forwarders[conID] = con
 			return &con.connection
 		})
+		lc.sendConnectionStatus(con)
 	}
 }
 
@@ -480,10 +605,116 @@ func (r *libp2pRelay) Friends(add []string, remove []string) error {
 		removePeerIDs[i], err = peer.Decode(friend)
 		if err != nil {return err}
 	}
-	treerequest.ChangePeers(conf.treeName, addPeerIDs, removePeerIDs)
+	added, removed := changeFriends(addPeerIDs, removePeerIDs)
+	treerequest.ChangePeers(conf.treeName, added, removed)
 	return nil
 }
 
+// LIST FRIENDS API METHOD
+func (r *libp2pRelay) ListFriends(c *client) {
+	c.writeMsgpack(&smsgFriendListParams{friendInfoList()})
+}
+
+// FRIEND INFO API METHOD
+func (r *libp2pRelay) FriendInfo(peerid string, nickname string, trust int) error {
+	friendPeer, err := peer.Decode(peerid)
+	if err != nil {return fmt.Errorf("error decoding peerID %s: %w", peerid, err)}
+	return setFriendInfo(friendPeer, nickname, trust)
+}
+
+// startForCommand starts the peer for command line subcommands
+func startForCommand() error {
+	if !useIPFSLite {return fmt.Errorf("this command requires IPFS")}
+	return centralRelay.relay.Start(commandTreeProtocol, commandTreeName, 0, peerKeyString, nil)
+}
+
+// runCommand runs a command line subcommand instead of the websocket server
+func runCommand(args []string) error {
+	switch args[0] {
+	case "car":
+		return carCommand(args[1:])
+	case "block":
+		return blockCommand(args[1:])
+	default:
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+}
+
+// BLOCK API METHOD
+func (r *libp2pRelay) Block(add []string, remove []string) error {
+	var dstor datastore.Datastore
+	if conf.dstor != nil {
+		dstor = conf.dstor
+	}
+	if err := blocked.change(dstor, add, remove); err != nil {return err}
+	disconnectBlocked()
+	return nil
+}
+
+// LIST BLOCKED API METHOD
+func (r *libp2pRelay) ListBlocked(c *client) {
+	c.writeMsgpack(&smsgBlockListParams{blocked.entries()})
+}
+
+// CONNECTED PEERS API METHOD
+func (r *libp2pRelay) ConnectedPeers(c *client) {
+	svc(r, func() {
+		msg := &smsgConnectedPeersParams{r.connectedPeerList()}
+		svc(c, func() {
+			c.writeMsgpack(msg)
+		})
+	})
+}
+
+// CREATE INVITE API METHOD
+func (r *libp2pRelay) CreateInvite(c *client, validFor int, oneTime bool) {
+	invite, err := createInvite(r.AddressArray(), time.Duration(validFor)*time.Second, oneTime)
+	if err != nil {
+		c.error(fmt.Sprintf("could not create invitation: %s", err))
+		return
+	}
+	c.writeMsgpack(&smsgInviteParams{invite})
+}
+
+// ACCEPT INVITE API METHOD
+func (r *libp2pRelay) AcceptInvite(c *client, invite string) {
+	body, addrInfo, err := decodeInvite(invite)
+	if err != nil {
+		c.error(fmt.Sprintf("could not accept invitation: %s", err))
+		return
+	}
+	accept := func() {
+		r.inviteAccepted(c, addrInfo.ID, body)
+	}
+	go func() {
+		err := r.host.Connect(context.Background(), *addrInfo)
+		if err != nil {
+			fmt.Printf("Could not connect to inviter %s: %s\n", addrInfo.ID.Pretty(), err)
+		}
+		if body.Token == "" || isFriend(addrInfo.ID) { // the token was used when the invitation was first accepted
+			svc(c, accept)
+			return
+		}
+		if err == nil {
+			err = presentInviteToken(context.Background(), r.host, addrInfo.ID, body.Token)
+		}
+		svc(c, func() {
+			if err != nil {
+				c.error(fmt.Sprintf("could not accept invitation: %s", err))
+				return
+			}
+			accept()
+		})
+	}()
+}
+
+// inviteAccepted makes the inviter a friend and tells the client
+func (r *libp2pRelay) inviteAccepted(c *client, inviter peer.ID, body *inviteBody) {
+	added, _ := changeFriends([]peer.ID{inviter}, nil)
+	treerequest.ChangePeers(conf.treeName, added, nil)
+	c.writeMsgpack(&smsgInviteAcceptedParams{body.PeerID, body.TreeName})
+}
+
 func logLine(str string, items ...interface{}) {
 	log.Output(2, fmt.Sprintf("[%d] %s", logCount, fmt.Sprintf(str, items...)))
 	logCount++
@@ -533,15 +764,20 @@ func (r *libp2pRelay) PeerKey() string {
 
 func (r *libp2pRelay) setNATStatus(status network.Reachability) {
 	r.natStatus = status
+	setNATStatusMetric(status)
 	for _, f := range r.natActions {
 		f()
 	}
 	r.natActions = []func(){}
+	if hopService != nil {
+		hopService.natChanged()
+	}
 }
 
 func createListener() *listener {
 	lis := new(listener)
 	lis.connections = make(map[uint64]*libp2pConnection)
+	lis.pending = make(map[uint64]*streamOffer)
 	lis.managementChan = make(chan func())
 	return lis
 }
@@ -555,11 +791,18 @@ func (l *listener) close(retainConnections bool) {
 }
 
 func (l *listener) closePrim() {
-	l.client.libp2pRelay().host.RemoveStreamHandler(protocol.ID(l.protocol))
+	l.client.libp2pRelay().leaveListenerGroup(l)
+	for conID, offer := range l.pending {
+		l.client.refuseOffer(offer)
+		delete(l.pending, conID)
+	}
 	delete(l.client.listeners, l.protocol)
 	for conID := range l.connections {
 		delete(l.client.listenerConnections, conID)
 	}
+	if !l.closed {
+		metricListeners.WithLabelValues(protocolLabel(l.protocol)).Dec()
+	}
 	l.closed = true
 }
 
@@ -597,6 +840,13 @@ func (c *libp2pClient) Close() {
 		for _, con := range c.forwarders {
 			con.close(func() {})
 		}
+		for name := range c.subscriptions {
+			c.unsubscribe(name)
+		}
+		for ns := range c.advertisements {
+			c.stopAdvertising(ns)
+		}
+		c.cancel()
 		if c.control != nil {
 			c.control.Close()
 			c.control = nil
@@ -609,16 +859,51 @@ func (c *libp2pClient) hasConnection(conID uint64) bool {
 	return c.listenerConnections[conID] != nil || c.forwarders[conID] != nil
 }
 
-func (c *libp2pClient) createConnection(conID uint64, prot string, stream network.Stream, frames bool) *libp2pConnection {
+func (c *libp2pClient) createConnection(conID uint64, prot string, peerID peer.ID, stream twoWayStream, frames bool) *libp2pConnection {
 	con := new(libp2pConnection)
-	con.peerID = stream.Conn().RemotePeer()
+	con.peerID = peerID
 	con.connection.init("connection", prot, conID, stream, &c.client, frames, con)
+	con.limiters = []*rate.Limiter{peerBandwidth(con.peerID), c.bandwidth}
 	fmt.Println("MAKING CONNECTION WITH ID ", con.id)
-	getLibp2pRelay(c.relay).host.ConnManager().Protect(con.peerID, "websocket")
-	svc(c.relay, func() { c.libp2pRelay().connectedPeers[con.peerID] = con })
+	con.protect()
+	svcSync(c.relay, func() interface{} { // synchronous so the add always precedes CleanupClosed's remove
+		c.libp2pRelay().addConnectedPeer(con)
+		return nil
+	})
 	return con
 }
 
+func (c *libp2pClient) aclFor(prot string) *listenerACL {
+	if acl := c.acls[prot]; acl != nil {return acl}
+	return openACL
+}
+
+func (c *libp2pClient) acceptListenerConnection(lis *listener, conID uint64, peerID peer.ID, stream twoWayStream) {
+	con := c.createConnection(conID, lis.protocol, peerID, stream, lis.frames)
+	fmt.Printf("GOT DIRECT CONNECTION ON %s FROM %s\n", lis.protocol, peerID.Pretty())
+	lis.connections[con.id] = con
+	c.listenerConnections[con.id] = lis
+	c.writeMsgpack(&smsgListenerConnectionParams{strconv.FormatUint(con.id, 10), peerID.Pretty(), lis.protocol})
+	c.sendConnectionStatus(con)
+	c.read(&con.connection)
+}
+
+// requestListenerConnection asks the client whether to accept a stream, refusing it if there is no answer in time
+func (c *libp2pClient) requestListenerConnection(lis *listener, conID uint64, offer *streamOffer) {
+	lis.pending[conID] = offer
+	c.writeMsgpack(&smsgListenerRequestParams{strconv.FormatUint(conID, 10), offer.stream.Conn().RemotePeer().Pretty(), lis.protocol})
+	time.AfterFunc(listenerRequestTimeout, func() {
+		svc(c, func() {
+			if pending := lis.pending[conID]; pending != nil {
+				fmt.Printf("CONNECTION REQUEST %d ON %s TIMED OUT\n", conID, lis.protocol)
+				delete(lis.pending, conID)
+				countRefusal("timeout")
+				c.refuseOffer(pending)
+			}
+		})
+	})
+}
+
 func (c *libp2pClient) createListener(prot string, frames bool) *listener {
 	lis := createListener()
 	lis.frames = frames
@@ -687,13 +972,12 @@ func initp2p(treeProtocol string) {
 		if customNatTraversal {
 			opts = []libp2p.Option{
 				//libp2p.NATPortMap(),
-				libp2p.ConnectionManager(connmgr.NewConnManager(50, 300, time.Minute)),
+				libp2p.ConnectionManager(newConnManager()),
 				libp2p.EnableAutoRelay(),
 				libp2p.EnableNATService(),
-				libp2p.Security(libp2ptls.ID, libp2ptls.New),
-				libp2p.Security(secio.ID, secio.New),
 				libp2p.DefaultTransports,
 			}
+			opts = append(opts, securityOptions()...)
 		} else {
 			opts = ipfslite.Libp2pOptionsExtra
 		}
@@ -704,18 +988,21 @@ func initp2p(treeProtocol string) {
 	} else {
 		opts = []libp2p.Option{
 			libp2p.ListenAddrs([]ma.Multiaddr(listenAddresses)...),
-			libp2p.ConnectionManager(connmgr.NewConnManager(50, 300, time.Minute)),
+			libp2p.ConnectionManager(newConnManager()),
 			libp2p.EnableAutoRelay(),
 			libp2p.EnableNATService(),
-			libp2p.Security(libp2ptls.ID, libp2ptls.New),
-			libp2p.Security(secio.ID, secio.New),
 			libp2p.DefaultTransports,
 		}
+		opts = append(opts, securityOptions()...)
 		if !customNatTraversal {
 			opts = append(opts, libp2p.NATPortMap())
 		}
 	}
 	opts = append(opts, libp2p.Transport(libp2pquic.NewTransport))
+	opts = append(opts, libp2p.ConnectionGater(blocked))
+	if relayFriends {
+		opts = append(opts, friendRelayOptions()...)
+	}
 	if peerKeyString != "" { // add peer key into opts if provided
 		keyBytes, err = crypto.ConfigDecodeKey(peerKeyString)
 		checkErr(err)
@@ -748,59 +1035,18 @@ func initp2p(treeProtocol string) {
 			}
 			if err == nil {
 				publicAddress.Store(addr) // set initial public address
-				opts = append(opts, libp2p.AddrsFactory(func(addrs []ma.Multiaddr) []ma.Multiaddr {
-					proto := ma.P_IP4
-					var addrStr string
-					addr, _ := publicAddress.Load().(ma.Multiaddr)
-					if addr != nil {
-						addrStr, err = addr.ValueForProtocol(proto)
-						if err != nil {
-							proto = ma.P_IP6
-							addrStr, err = addr.ValueForProtocol(proto)
-						}
-					}
-					if addr == nil || err != nil {return addrs}
-					// replace addr for same IP addr in case it changed
-					for i, tmpAddr := range addrs {
-						var tmpStr string
-						tmpStr, err = tmpAddr.ValueForProtocol(proto)
-						if err == nil && tmpStr == addrStr {
-							addrs[i] = addr
-							return addrs
-						}
-					}
-					return append(addrs, addr)
-				}))
+				atomic.StoreInt32(&publicUDPPort, int32(mapping.udpPort))
+				opts = append(opts, libp2p.AddrsFactory(addPublicAddrs))
 			}
 		}
 	}
 	if useIPFSLite {
-		ipfsDir, err := ipfsconfig.Filename("")
+		path, err := datastorePath()
 		checkErr(err)
-		path := filepath.Join(filepath.Dir(ipfsDir), configDir)
-		fmt.Println("DATA STORE:", path)
-		if _, err = os.Stat(path); err != nil {
-			parent := filepath.Dir(path)
-			_, err = os.Stat(parent)
-			if err != nil {
-				grandParent := filepath.Dir(parent)
-				_, err = os.Stat(grandParent)
-				if err != nil {
-					fmt.Printf("\n\nCOULD NOT CREATE CONFIG DIRECTORY: %s\n\n", path)
-					panic(err)
-				}
-				err = os.Mkdir(parent, 0700)
-				if err != nil {
-					fmt.Printf("\n\nCOULD NOT CREATE CONFIG DIRECTORY PARENT: %s\n\n", parent)
-					panic(err)
-				}
-			}
-			err = os.Mkdir(path, 0700)
-			checkErr(err)
-		}
 		fmt.Println("Datastore:", path)
 		conf.dstor, err = ipfslite.BadgerDatastore(path)
 		checkErr(err)
+		checkErr(blocked.load(conf.dstor))
 		fmt.Println("Listen addresses:")
 		printMaddrs(listenAddresses, "")
 		conf.myHost, conf.dht, err = ipfslite.SetupLibp2p(
@@ -815,6 +1061,8 @@ func initp2p(treeProtocol string) {
 		conf.lite, err = ipfslite.New(ctx, conf.dstor, conf.myHost, conf.dht, nil)
 		checkErr(err)
 		conf.publisher = namesys.NewIpnsPublisher(conf.dht, conf.dstor)
+		centralRelay.discovery = discovery.NewRoutingDiscovery(conf.dht)
+		peerFinder = conf.dht
 		conf.pin, err = pinner.LoadPinner(conf.dstor, conf.lite, conf.lite)
 		if err != nil {
 			conf.pin = pinner.NewPinner(conf.dstor, conf.lite, conf.lite)
@@ -824,8 +1072,19 @@ func initp2p(treeProtocol string) {
 	}
 	checkErr(err)
 	fmt.Println("Addrs:", conf.myHost.Addrs())
+	initFriends()
+	checkErr(initPubsub(ctx))
+	if useMdns {
+		checkErr(initMdns(ctx, centralRelay))
+	}
 	centralRelay.peerID = conf.myHost.ID().Pretty()
 	centralRelay.host = conf.myHost
+	centralRelay.watchConnections()
+	conf.myHost.SetStreamHandler(inviteProtocol, handleInviteStream)
+	checkErr(centralRelay.watchAddresses())
+	if relayFriends {
+		checkErr(initFriendRelay(centralRelay))
+	}
 	checkVersion()
 	if fakeNatStatus == "public" {
 		centralRelay.setNATStatus(network.ReachabilityPublic)
@@ -844,43 +1103,7 @@ func initp2p(treeProtocol string) {
 		checkErr(err)
 		centralRelay.natStatus = network.ReachabilityUnknown
 		//need to check reachability even when not natted because of fw rules
-		go func() {
-			peeped := false
-			timer := time.NewTimer(0)
-			oldAddr, _ := publicAddress.Load().(ma.Multiaddr)
-			init := true
-
-			for running := true; running; {
-				timer.Reset(1 * time.Second) // check autonat every second until it finds status
-				_, ok := <-timer.C
-				if !ok {break}
-				status := an.Status()
-				svcSync(centralRelay, func() interface{} {
-					if status != centralRelay.natStatus || !peeped {
-						fmt.Println("@@@ NAT status", natStatus(status))
-						addr, err := an.PublicAddr()
-						if err == nil {
-							fmt.Println("@@@ PUBLIC ADDRESS: ", addr)
-							centralRelay.printAddresses()
-							if customNatTraversal && oldAddr != addr {
-								publicAddress.Store(addr)
-							}
-						}
-						if status != network.ReachabilityUnknown {
-							centralRelay.setNATStatus(status)
-						}
-						accessChan <- status
-						if init {
-							init = false
-							err := initTree(ctx, treeProtocol)
-							checkErr(err)
-						}
-					}
-					return nil
-				})
-				peeped = true
-			}
-		}()
+		go centralRelay.monitorReachability(ctx, an, treeProtocol)
 	}
 	conf.peerKey = conf.myHost.Peerstore().PrivKey(conf.myHost.ID())
 	keyBytes, err = crypto.MarshalPrivateKey(conf.peerKey)
@@ -918,23 +1141,34 @@ func initp2p(treeProtocol string) {
 	fmt.Println("FINISHED INITIALIZING P2P, CREATING RELAY")
 	runSvc(centralRelay)
 	fmt.Printf("Peer id: %v\n", centralRelay.peerID)
-	if decodeHash != "" && useIPFSLite {
-		///// fetch the node, try using ipld.Decode(NewBlock(node.RawData())) to make a node
-		location := "local"
-		cid, err := cid.Decode(decodeHash)
-		checkErr(err)
-		fmt.Printf("CID: %v\n", cid)
-		block, err := conf.lite.BlockStore().Get(cid)
-		checkErr(err)
-		if block == nil {
-			location = "remote"
-			block, err = conf.lite.Session(context.Background()).Get(context.Background(), cid)
-			checkErr(err)
-		}
 
-		fmt.Printf("Block [%s]: %v\n", location, block)
-	}
+}
 
+// datastorePath returns the config directory within the ipfs config directory, creating it if needed
+func datastorePath() (string, error) {
+	ipfsDir, err := ipfsconfig.Filename("")
+	if err != nil {return "", err}
+	path := filepath.Join(filepath.Dir(ipfsDir), configDir)
+	fmt.Println("DATA STORE:", path)
+	if _, err = os.Stat(path); err != nil {
+		parent := filepath.Dir(path)
+		_, err = os.Stat(parent)
+		if err != nil {
+			grandParent := filepath.Dir(parent)
+			_, err = os.Stat(grandParent)
+			if err != nil {
+				fmt.Printf("\n\nCOULD NOT CREATE CONFIG DIRECTORY: %s\n\n", path)
+				return "", err
+			}
+			err = os.Mkdir(parent, 0700)
+			if err != nil {
+				fmt.Printf("\n\nCOULD NOT CREATE CONFIG DIRECTORY PARENT: %s\n\n", parent)
+				return "", err
+			}
+		}
+		if err = os.Mkdir(path, 0700); err != nil {return "", err}
+	}
+	return path, nil
 }
 
 func initTree(ctx context.Context, treeProtocol string) error {
@@ -958,10 +1192,13 @@ func initTree(ctx context.Context, treeProtocol string) error {
 	if err == nil { // publish to IPNS on startup
 		publishFile("/", tree.Root())
 	}
+	close(treeReady)
 	return nil
 }
 
 func friends() []peer.ID {
+	friendsLock.Lock()
+	defer friendsLock.Unlock()
 	friends := make([]peer.ID, len(conf.friends))
 	i := 0
 	for friend := range conf.friends {
@@ -1060,12 +1297,6 @@ func stringsToAddrs(addrStrings []string) (maddrs []ma.Multiaddr, err error) {
 
 }
 
-type portMapResult struct {
-	natter nat.NAT
-	addr   net.TCPAddr
-	err    error
-}
-
 func isPrivateIPv4(addr net.IP) bool {
 	a := addr[0]
 	b := addr[1]
@@ -1107,65 +1338,6 @@ func isPrivate(addr net.IP) bool {
 	return isPrivateIPv6(addr)
 }
 
-func mapPort(ctx context.Context, port int) chan portMapResult {
-	result := make(chan portMapResult)
-	go func() {
-		fmt.Println("DISCOVERING NAT CONTROLLERS...")
-		natChan := nat.DiscoverNATs(context.Background())
-		var natter nat.NAT
-		timer := time.NewTimer(5 * time.Second)
-
-		select {
-		case <-timer.C:
-			timer.Stop()
-			hasNat = false
-			fmt.Println("NO NAT MANAGER FOUND")
-			result <- portMapErrString("No NAT found")
-			return
-		case natter = <-natChan:
-			timer.Stop()
-			fmt.Println("FOUND NAT MANAGER")
-			ip, err := natter.GetExternalAddress()
-			if err != nil {
-				result <- portMapErr(err)
-				return
-			}
-			fmt.Println("EXTERNAL ADDRESS:", ip)
-			extPort, err := natter.AddPortMapping("tcp", port, "port for websocket peer", portMapLeaseTime)
-			if err != nil {
-				result <- portMapErr(err)
-				return
-			}
-			fmt.Println("MAPPED PORT:", extPort)
-			go func() {
-			loop:
-				for {
-					timer.Reset(portMapLeaseTime - 5*time.Second)
-					select {
-					case <-ctx.Done():
-						break loop
-					case <-timer.C:
-						_, err := natter.AddPortMapping("tcp", port, "port for websocket peer", portMapLeaseTime)
-						if err != nil {
-							break loop
-						}
-					}
-				}
-			}()
-			result <- portMapResult{natter, net.TCPAddr{IP: ip, Port: extPort, Zone: ""}, nil}
-		}
-	}()
-	return result
-}
-
-func portMapErrString(err string) portMapResult {
-	return portMapResult{nil, net.TCPAddr{IP: net.IPv4zero, Port: 0, Zone: ""}, fmt.Errorf(err)}
-}
-
-func portMapErr(err error) portMapResult {
-	return portMapResult{nil, net.TCPAddr{IP: net.IPv4zero, Port: 0, Zone: ""}, err}
-}
-
 func errstrw(format string, args ...interface{}) string {
 	return errstr(format+": %w", args...)
 }
@@ -1250,10 +1422,10 @@ func main() {
 	noIPFS := false
 	publishTreeString := ""
 
-	flag.StringVar(&decodeHash, "decode", "", "Test decodinf an IPFS block")
 	flag.BoolVar(&noIPFS, "noipfs", false, "Don't use ipfs")
 	flag.StringVar(&configDir, "config", configDir, "Name of the subdirectory within the ipfs config directory to use for the config")
 	flag.BoolVar(&noBootstrap, "nopeers", false, "Clear the bootstrap peer list")
+	flag.BoolVar(&useMdns, "mdns", false, "Discover peers on the local network with mDNS")
 	flag.StringVar(&peerKeyString, "key", "", "Specify peer key")
 	flag.Var(&fileList, "files", "Add the contents of a directory to serve from /")
 	flag.StringVar(&addr, "addr", "", "Host address to listen on")
@@ -1264,18 +1436,39 @@ func main() {
 	flag.BoolVar(&nobrowse, "nobrowse", false, "Do not launch browser")
 	flag.BoolVar(&fakeNATPrivate, "fakenatprivate", false, "Pretend nat is private")
 	flag.BoolVar(&fakeNATPublic, "fakenatpublic", false, "Pretend nat is publc")
+	flag.StringVar(&fakeNATSpec, "fakenat", "", "Simulate a NAT gateway, for example lose=1m,outage=30s (see fakenat.go)")
+	flag.DurationVar(&portMapRenewal, "natrenewal", portMapRenewal, "How often to renew NAT port mappings, must be shorter than their 10s lease")
 	flag.BoolVar(&version, "version", false, "Print version number and exit")
 	roy, bill := false, false
 	flag.BoolVar(&roy, "roy", false, "Test as Roy")
 	flag.BoolVar(&bill, "bill", false, "Test as Bill")
 	flag.StringVar(&publishTreeString, "tree", "", "IPFS tree to publish")
 	flag.BoolVar(&clearTree, "cleartree", false, "Clear the published tree")
+	flag.StringVar(&commandTreeProtocol, "treeprotocol", "", "Tree protocol to use for command line subcommands")
+	flag.StringVar(&commandTreeName, "treename", "", "Tree name to use for command line subcommands")
+	flag.IntVar(&limits.peerStreams, "maxpeerstreams", 0, "Maximum concurrent streams with one peer, 0 for no limit")
+	flag.IntVar(&limits.peerStreamRate, "maxpeerstreamrate", 0, "Maximum new streams per minute from one peer, 0 for no limit")
+	flag.IntVar(&limits.peerBandwidth, "peerbandwidth", 0, "Maximum bytes per second to and from one peer, 0 for no limit")
+	flag.IntVar(&limits.clientConnections, "maxclientconnections", 0, "Maximum concurrent connections for one websocket client, 0 for no limit")
+	flag.IntVar(&limits.clientBandwidth, "clientbandwidth", 0, "Maximum bytes per second for one websocket client, 0 for no limit")
+	flag.BoolVar(&relayFriends, "relayfriends", false, "Relay circuits for friends while this peer is publicly reachable")
+	flag.IntVar(&relayLimits.slots, "relayslots", relayLimits.slots, "Maximum concurrent circuits relayed for friends")
+	flag.DurationVar(&relayLimits.duration, "relayduration", relayLimits.duration, "Maximum time a relayed circuit may stay open")
+	flag.Int64Var(&relayLimits.data, "relaydata", relayLimits.data, "Maximum bytes a relayed circuit may carry")
+	flag.IntVar(&connManagerConfig.low, "connlow", connManagerConfig.low, "Connection manager low water mark")
+	flag.IntVar(&connManagerConfig.high, "connhigh", connManagerConfig.high, "Connection manager high water mark")
+	flag.DurationVar(&connManagerConfig.grace, "conngrace", connManagerConfig.grace, "Connection manager grace period for new connections")
+	flag.DurationVar(&sessionGrace, "sessiongrace", sessionGrace, "How long to keep a client's connections after its websocket closes, 0 to close them at once")
 	if roy {
 		test = "roy"
 	} else if bill {
 		test = "bill"
 	}
 	flag.Parse()
+	if portMapRenewal <= 0 || portMapRenewal >= portMapLeaseTime {
+		fmt.Printf("-natrenewal must be greater than 0 and less than the %v lease\n", portMapLeaseTime)
+		os.Exit(2)
+	}
 	if publishTreeString != "" {
 		var err error
 		publishTree, err = cid.Decode(publishTreeString)
@@ -1300,10 +1493,28 @@ func main() {
 	} else if fakeNATPublic {
 		fakeNatStatus = "public"
 	}
+	if fakeNATSpec != "" {
+		fake, err := parseFakeNAT(fakeNATSpec)
+		checkErr(err)
+		natDevices = fake
+	}
+	if flag.NArg() > 0 {
+		checkErr(runCommand(flag.Args()))
+		os.Exit(0)
+	}
 	fmt.Printf("Listening on port %v\n", port)
 	http.HandleFunc("/libp2p", centralRelay.handleConnection())
 	handleUrlEffect("/peerID/", validateID)
 	handleUrlJSON("/peerCID/", handlePeerCID)
+	http.HandleFunc("/block/", handleBlock)
+	http.HandleFunc("/dag/", handleDag)
+	http.HandleFunc("/car/export/", handleCarExport)
+	http.HandleFunc("/car/import", handleCarImport)
+	http.HandleFunc("/share/", handleShare)
+	http.HandleFunc("/shared/", handleShared)
+	http.HandleFunc("/status", handleStatus)
+	http.HandleFunc("/status.html", handleStatusPage)
+	http.Handle("/metrics", promhttp.Handler())
 	if len(fileList) > 0 {
 		for _, dir := range fileList {
 			fmt.Println("File dir: ", dir)
@@ -0,0 +1,195 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+/*
+# RESOURCE LIMITS
+
+Limits on streams and bandwidth protect the relay from misbehaving peers and clients. They are
+set with command line flags and are off by default.
+
+```
+  -maxpeerstreams N       -- concurrent streams with one peer
+  -maxpeerstreamrate N    -- new streams per minute from one peer
+  -peerbandwidth N        -- bytes per second to and from one peer
+  -maxclientconnections N -- concurrent connections for one websocket client
+  -clientbandwidth N      -- bytes per second for one websocket client
+```
+
+Incoming streams over a limit are reset and the client receives Limit Exceeded. Connect requests
+over a limit receive Peer Connection Refused. Bandwidth limits throttle reads and writes.
+
+A peer's usage is forgotten once it has no streams and has been idle long enough for its limiters
+to fill up again, so forgetting it does not loosen its limits. Idle usages are swept at most once
+every peerUsageSweep.
+*/
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/time/rate"
+)
+
+// resource limits, zero means no limit
+var limits struct {
+	peerStreams       int // concurrent streams with one peer
+	peerStreamRate    int // new streams per minute from one peer
+	peerBandwidth     int // bytes per second to and from one peer
+	clientConnections int // concurrent connections for one websocket client
+	clientBandwidth   int // bytes per second for one websocket client
+}
+
+const peerUsageSweep = time.Minute
+
+type peerUsage struct {
+	streams    int
+	newStreams *rate.Limiter
+	bandwidth  *rate.Limiter
+	lastUsed   time.Time
+}
+
+var peerUsageLock sync.Mutex
+var peerUsages = make(map[peer.ID]*peerUsage)
+var lastPeerUsageSweep = time.Now()
+
+// usageFor must be called with peerUsageLock held
+func usageFor(peerID peer.ID) *peerUsage {
+	now := time.Now()
+	if now.Sub(lastPeerUsageSweep) >= peerUsageSweep {
+		sweepPeerUsages(now)
+	}
+	usage := peerUsages[peerID]
+	if usage == nil {
+		usage = new(peerUsage)
+		if limits.peerStreamRate > 0 {
+			usage.newStreams = rate.NewLimiter(rate.Every(time.Minute/time.Duration(limits.peerStreamRate)), limits.peerStreamRate)
+		}
+		usage.bandwidth = bandwidthLimiter(limits.peerBandwidth)
+		peerUsages[peerID] = usage
+	}
+	usage.lastUsed = now
+	return usage
+}
+
+// sweepPeerUsages forgets idle usages, it must be called with peerUsageLock held
+func sweepPeerUsages(now time.Time) {
+	lastPeerUsageSweep = now
+	for peerID, usage := range peerUsages {
+		if usage.idle(now) {
+			delete(peerUsages, peerID)
+		}
+	}
+}
+
+// idle returns whether the usage has no streams and its limiters are full again
+func (u *peerUsage) idle(now time.Time) bool {
+	if u.streams > 0 {return false}
+	for _, limiter := range []*rate.Limiter{u.newStreams, u.bandwidth} {
+		if limiter != nil && now.Sub(u.lastUsed) < refillTime(limiter) {return false}
+	}
+	return true
+}
+
+// refillTime is how long an empty limiter takes to fill up
+func refillTime(limiter *rate.Limiter) time.Duration {
+	return time.Duration(float64(limiter.Burst()) / float64(limiter.Limit()) * float64(time.Second))
+}
+
+func bandwidthLimiter(bytesPerSecond int) *rate.Limiter {
+	if bytesPerSecond <= 0 {return nil}
+	burst := bytesPerSecond
+	if burst < maxMessageSize+4 { // must hold a full message plus its frame length
+		burst = maxMessageSize + 4
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+}
+
+// startPeerStream reserves a stream with peerID, returning an error if that would exceed a limit
+func startPeerStream(peerID peer.ID, clientConnections int) error {
+	if limits.clientConnections > 0 && clientConnections >= limits.clientConnections {
+		return fmt.Errorf("client connection limit reached (%d)", limits.clientConnections)
+	}
+	peerUsageLock.Lock()
+	defer peerUsageLock.Unlock()
+	usage := usageFor(peerID)
+	if limits.peerStreams > 0 && usage.streams >= limits.peerStreams {
+		return fmt.Errorf("stream limit for peer %s reached (%d)", peerID.Pretty(), limits.peerStreams)
+	}
+	if usage.newStreams != nil && !usage.newStreams.Allow() {
+		return fmt.Errorf("peer %s is opening streams too fast (limit %d per minute)", peerID.Pretty(), limits.peerStreamRate)
+	}
+	usage.streams++
+	return nil
+}
+
+func endPeerStream(peerID peer.ID) {
+	peerUsageLock.Lock()
+	defer peerUsageLock.Unlock()
+	usage := peerUsages[peerID]
+	if usage == nil {return}
+	usage.streams--
+	usage.lastUsed = time.Now()
+	if usage.idle(usage.lastUsed) {
+		delete(peerUsages, peerID)
+	}
+}
+
+func peerBandwidth(peerID peer.ID) *rate.Limiter {
+	peerUsageLock.Lock()
+	defer peerUsageLock.Unlock()
+	return usageFor(peerID).bandwidth
+}
+
+// reserveStream counts a new stream with peerID for the client, failing if that would exceed a limit
+func (c *libp2pClient) reserveStream(peerID peer.ID) error {
+	if err := startPeerStream(peerID, int(atomic.LoadInt32(&c.streamCount))); err != nil {return err}
+	atomic.AddInt32(&c.streamCount, 1)
+	return nil
+}
+
+func (c *libp2pClient) releaseStream(peerID peer.ID) {
+	atomic.AddInt32(&c.streamCount, -1)
+	endPeerStream(peerID)
+}
+
+// refuseOffer declines a reserved stream that will not become a connection
+func (c *libp2pClient) refuseOffer(offer *streamOffer) {
+	offer.decline()
+	c.releaseStream(offer.stream.Conn().RemotePeer())
+}
+
+// throttle waits until the limiters allow n more bytes
+func throttle(limiters []*rate.Limiter, n int) {
+	for _, limiter := range limiters {
+		if limiter != nil {
+			limiter.WaitN(context.Background(), n)
+		}
+	}
+}
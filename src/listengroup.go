@@ -0,0 +1,369 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+/*
+# SHARED LISTENERS
+
+Several clients can listen on the same protocol. Their listeners form a group that owns the
+libp2p stream handler and routes each incoming stream according to the group's mode, which
+any member can set with ListenMode:
+
+```
+  0: round robin     -- each stream goes to the next client in turn
+  1: first responder -- each stream is offered to every client with Listener Request,
+                        the first client to accept it gets it
+  2: fan out         -- each stream is shared by every client, incoming data is copied to
+                        all of them and data from any of them is written to the stream
+```
+
+Listener access control and resource limits apply to each client separately.
+
+In fan out mode each client has its own buffer of up to fanOutBacklog reads from the stream. A
+client that lets its buffer fill up is dropped from the shared stream, so one slow client does
+not hold up the others.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+type routeMode int
+
+const (
+	routeRoundRobin     routeMode = iota // each stream goes to the next client
+	routeFirstResponder                  // each stream is offered to every client
+	routeFanOut                          // each stream is shared by every client
+)
+
+type listenerGroup struct {
+	lock     sync.Mutex
+	protocol string
+	mode     routeMode
+	members  []*listener
+	next     int
+}
+
+// streamOffer is an incoming stream offered to one or more clients
+type streamOffer struct {
+	lock    sync.Mutex
+	stream  network.Stream
+	waiting int // clients that have not answered
+	taken   bool
+}
+
+// fanOutStream shares one libp2p stream among several clients
+type fanOutStream struct {
+	stream    network.Stream
+	writeLock sync.Mutex
+	lock      sync.Mutex
+	endpoints []*fanOutEndpoint
+	open      int
+}
+
+// fanOutEndpoint is one client's view of a fanOutStream
+type fanOutEndpoint struct {
+	fan      *fanOutStream
+	incoming chan []byte // data waiting for the client, closed when the endpoint ends
+	pending  []byte      // the unread rest of a chunk, only used by Read
+	err      error       // why incoming was closed
+	ended    bool        // incoming is closed
+	closed   bool
+}
+
+const fanOutBacklog = 16 // reads an endpoint may fall behind the shared stream
+
+var errFanOutBehind = errors.New("fell behind the shared stream")
+
+var listenerGroupsLock sync.Mutex
+var listenerGroups = make(map[string]*listenerGroup) // protocol -> group
+
+// joinListenerGroup adds a listener to its protocol's group, creating the group if needed
+func (r *libp2pRelay) joinListenerGroup(lis *listener) error {
+	listenerGroupsLock.Lock()
+	defer listenerGroupsLock.Unlock()
+	group := listenerGroups[lis.protocol]
+	if group == nil {
+		for _, currentProt := range r.host.Mux().Protocols() {
+			if currentProt == lis.protocol {return fmt.Errorf("%s is used by another service", lis.protocol)}
+		}
+		group = &listenerGroup{protocol: lis.protocol}
+		listenerGroups[lis.protocol] = group
+		r.host.SetStreamHandler(protocol.ID(lis.protocol), group.handleStream)
+	}
+	group.lock.Lock()
+	defer group.lock.Unlock()
+	group.members = append(group.members, lis)
+	return nil
+}
+
+// leaveListenerGroup removes a listener from its group, removing the stream handler when the group is empty
+func (r *libp2pRelay) leaveListenerGroup(lis *listener) {
+	listenerGroupsLock.Lock()
+	defer listenerGroupsLock.Unlock()
+	group := listenerGroups[lis.protocol]
+	if group == nil {return}
+	group.lock.Lock()
+	defer group.lock.Unlock()
+	for i, member := range group.members {
+		if member == lis {
+			group.members = append(group.members[:i], group.members[i+1:]...)
+			break
+		}
+	}
+	if len(group.members) == 0 {
+		r.host.RemoveStreamHandler(protocol.ID(lis.protocol))
+		delete(listenerGroups, lis.protocol)
+	}
+}
+
+func setListenerGroupMode(prot string, mode int) error {
+	if mode < int(routeRoundRobin) || mode > int(routeFanOut) {return fmt.Errorf("bad listen mode: %d", mode)}
+	listenerGroupsLock.Lock()
+	defer listenerGroupsLock.Unlock()
+	group := listenerGroups[prot]
+	if group == nil {return fmt.Errorf("not listening to %s", prot)}
+	group.lock.Lock()
+	defer group.lock.Unlock()
+	group.mode = routeMode(mode)
+	return nil
+}
+
+func (g *listenerGroup) handleStream(stream network.Stream) {
+	fmt.Println("GOT A CONNECTION")
+	g.lock.Lock()
+	members := append([]*listener(nil), g.members...)
+	mode := g.mode
+	next := 0
+	if len(members) > 0 {
+		next = g.next % len(members)
+		g.next = next + 1
+	}
+	g.lock.Unlock()
+	switch {
+	case len(members) == 0:
+		stream.Reset()
+	case mode == routeFirstResponder:
+		offer := createStreamOffer(stream, len(members))
+		for _, lis := range members {
+			lis.offerStream(offer, true)
+		}
+	case mode == routeFanOut:
+		fanOut(stream, members)
+	default:
+		members[next].offerStream(createStreamOffer(stream, 1), false)
+	}
+}
+
+func createStreamOffer(stream network.Stream, clients int) *streamOffer {
+	return &streamOffer{stream: stream, waiting: clients}
+}
+
+// take returns whether the caller gets the stream
+func (o *streamOffer) take() bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.waiting--
+	if o.taken {return false}
+	o.taken = true
+	return true
+}
+
+// decline resets the stream once every client has declined it
+func (o *streamOffer) decline() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.waiting--
+	if o.waiting == 0 && !o.taken {
+		o.stream.Reset()
+	}
+}
+
+// offerStream offers an incoming stream to the listener's client, asking the client first if ask is true
+func (l *listener) offerStream(offer *streamOffer, ask bool) {
+	c := l.client
+	svc(c, func() {
+		remotePeer := offer.stream.Conn().RemotePeer()
+		if l.closed {
+			offer.decline()
+			return
+		}
+		if err := c.reserveStream(remotePeer); err != nil {
+			fmt.Printf("REFUSING CONNECTION ON %s FROM %s: %v\n", l.protocol, remotePeer.Pretty(), err)
+			countRefusal("limit")
+			offer.decline()
+			c.writeMsgpack(&smsgLimitExceededParams{remotePeer.Pretty(), l.protocol, err.Error()})
+			return
+		}
+		decision := c.aclFor(l.protocol).check(remotePeer)
+		if decision == aclAccept && ask {
+			decision = aclAskClient
+		}
+		switch decision {
+		case aclReject:
+			fmt.Printf("REFUSING CONNECTION ON %s FROM %s\n", l.protocol, remotePeer.Pretty())
+			countRefusal("acl")
+			c.refuseOffer(offer)
+		case aclAskClient:
+			c.requestListenerConnection(l, c.newConnectionID(), offer)
+		default:
+			offer.take()
+			c.acceptListenerConnection(l, c.newConnectionID(), remotePeer, offer.stream)
+		}
+	})
+}
+
+// fanOut shares stream with every listener whose client accepts it
+func fanOut(stream network.Stream, members []*listener) {
+	remotePeer := stream.Conn().RemotePeer()
+	fan := &fanOutStream{stream: stream}
+	for _, lis := range members {
+		lis := lis
+		c := lis.client
+		endpoint := svcSync(c, func() interface{} {
+			if lis.closed {return nil}
+			if err := c.reserveStream(remotePeer); err != nil {
+				fmt.Printf("REFUSING CONNECTION ON %s FROM %s: %v\n", lis.protocol, remotePeer.Pretty(), err)
+				countRefusal("limit")
+				c.writeMsgpack(&smsgLimitExceededParams{remotePeer.Pretty(), lis.protocol, err.Error()})
+				return nil
+			}
+			if c.aclFor(lis.protocol).check(remotePeer) != aclAccept {
+				countRefusal("acl")
+				c.releaseStream(remotePeer)
+				return nil
+			}
+			endpoint := fan.addEndpoint()
+			c.acceptListenerConnection(lis, c.newConnectionID(), remotePeer, endpoint)
+			return endpoint
+		})
+		if endpoint == nil {
+			fmt.Printf("CLIENT DID NOT JOIN SHARED CONNECTION ON %s FROM %s\n", lis.protocol, remotePeer.Pretty())
+		}
+	}
+	fan.lock.Lock()
+	joined := len(fan.endpoints)
+	fan.lock.Unlock()
+	if joined == 0 {
+		stream.Reset()
+		return
+	}
+	go fan.pump()
+}
+
+func (f *fanOutStream) addEndpoint() *fanOutEndpoint {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	endpoint := &fanOutEndpoint{fan: f, incoming: make(chan []byte, fanOutBacklog)}
+	f.endpoints = append(f.endpoints, endpoint)
+	f.open++
+	return endpoint
+}
+
+// pump copies incoming data to every open endpoint, ending endpoints whose buffers are full
+func (f *fanOutStream) pump() {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := f.stream.Read(buf)
+		if n > 0 {
+			data := append([]byte(nil), buf[:n]...)
+			f.lock.Lock()
+			for _, endpoint := range f.endpoints {
+				if endpoint.ended {continue}
+				select {
+				case endpoint.incoming <- data:
+				default:
+					fmt.Printf("DROPPING CLIENT FROM SHARED CONNECTION FROM %s: %v\n", f.stream.Conn().RemotePeer().Pretty(), errFanOutBehind)
+					endpoint.end(errFanOutBehind)
+				}
+			}
+			f.lock.Unlock()
+		}
+		if err != nil {
+			f.lock.Lock()
+			for _, endpoint := range f.endpoints {
+				endpoint.end(err)
+			}
+			f.lock.Unlock()
+			return
+		}
+	}
+}
+
+// end stops delivering data, Read returns err after the buffered data, it must be called with fan.lock held
+func (e *fanOutEndpoint) end(err error) {
+	if e.ended {return}
+	e.ended = true
+	e.err = err
+	close(e.incoming)
+}
+
+func (e *fanOutEndpoint) Read(buf []byte) (int, error) {
+	if len(e.pending) == 0 {
+		data, ok := <-e.incoming
+		if !ok {return 0, e.err}
+		e.pending = data
+	}
+	n := copy(buf, e.pending)
+	e.pending = e.pending[n:]
+	return n, nil
+}
+
+// Write sends all of data to the shared stream so writes from different clients do not interleave
+func (e *fanOutEndpoint) Write(data []byte) (int, error) {
+	e.fan.writeLock.Lock()
+	defer e.fan.writeLock.Unlock()
+	total := 0
+	for total < len(data) {
+		n, err := e.fan.stream.Write(data[total:])
+		total += n
+		if err != nil {return total, err}
+	}
+	return total, nil
+}
+
+// Close closes this endpoint, closing the shared stream after the last one
+func (e *fanOutEndpoint) Close() error {
+	e.fan.lock.Lock()
+	defer e.fan.lock.Unlock()
+	if e.closed {return nil}
+	e.closed = true
+	e.end(io.ErrClosedPipe)
+	e.fan.open--
+	if e.fan.open == 0 {return e.fan.stream.Close()}
+	return nil
+}
+
+// deadlines belong to the shared stream, so endpoints ignore them
+func (e *fanOutEndpoint) SetDeadline(t time.Time) error      { return nil }
+func (e *fanOutEndpoint) SetReadDeadline(t time.Time) error  { return nil }
+func (e *fanOutEndpoint) SetWriteDeadline(t time.Time) error { return nil }
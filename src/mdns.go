@@ -0,0 +1,154 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+/*
+# LOCAL NETWORK DISCOVERY
+
+With -mdns, peers on the local network are found with multicast DNS, so peers can find each
+other without internet access. Each LAN peer is sent to clients in a LAN Peer message. LAN
+friends are connected right away, which updates their presence. Connect puts a peer's LAN
+addresses first and, since addresses are dialed in parallel, the LAN address normally wins.
+
+A LAN peer that mDNS has not seen for lanPeerExpiry is forgotten, so its old LAN addresses stop
+being dialed. LAN friends that were reported online are then reported offline, unless the host
+is still connected to them some other way, such as over the WAN or a relay.
+*/
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	mdns "github.com/libp2p/go-libp2p/p2p/discovery"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	mdnsServiceTag = "libp2p-websocket"
+	mdnsInterval   = 10 * time.Second
+	lanPeerExpiry  = 3 * mdnsInterval
+)
+
+var useMdns = false
+
+type lanNotifee struct {
+	relay *libp2pRelay
+}
+
+type lanPeer struct {
+	addrs    []ma.Multiaddr // addresses found on the local network
+	lastSeen time.Time
+	online   bool // presence was sent as online
+}
+
+var lanPeersLock sync.Mutex
+var lanPeers = make(map[peer.ID]*lanPeer)
+
+func initMdns(ctx context.Context, r *libp2pRelay) error {
+	service, err := mdns.NewMdnsService(ctx, conf.myHost, mdnsInterval, mdnsServiceTag)
+	if err != nil {return err}
+	service.RegisterNotifee(&lanNotifee{r})
+	go expireLanPeers(ctx, r)
+	fmt.Println("MDNS DISCOVERY STARTED")
+	return nil
+}
+
+func (n *lanNotifee) HandlePeerFound(addrInfo peer.AddrInfo) {
+	if addrInfo.ID == conf.myHost.ID() {return}
+	lanPeersLock.Lock()
+	lan, known := lanPeers[addrInfo.ID]
+	if !known {
+		lan = new(lanPeer)
+		lanPeers[addrInfo.ID] = lan
+	}
+	lan.addrs = addrInfo.Addrs
+	lan.lastSeen = time.Now()
+	lanPeersLock.Unlock()
+	conf.myHost.Peerstore().AddAddrs(addrInfo.ID, addrInfo.Addrs, peerstore.TempAddrTTL)
+	if known {return}
+	fmt.Println("FOUND LAN PEER", addrInfo.ID.Pretty(), addrInfo.Addrs)
+	addrs := make([]string, len(addrInfo.Addrs))
+	for i, addr := range addrInfo.Addrs {
+		addrs[i] = addr.String()
+	}
+	n.relay.broadcast(&smsgLanPeerParams{addrInfo.ID.Pretty(), addrs})
+	if isFriend(addrInfo.ID) {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := conf.myHost.Connect(ctx, addrInfo); err != nil {
+				fmt.Println("COULD NOT CONNECT TO LAN FRIEND", addrInfo.ID.Pretty(), err)
+				return
+			}
+			lanPeersLock.Lock()
+			current := lanPeers[addrInfo.ID] == lan
+			lan.online = current
+			lanPeersLock.Unlock()
+			if !current {return}
+			n.relay.broadcast(&smsgPresenceChangeParams{[]string{addrInfo.ID.Pretty()}, nil})
+		}()
+	}
+}
+
+// lanAddrs returns the local network addresses found for peerID
+func lanAddrs(peerID peer.ID) []ma.Multiaddr {
+	lanPeersLock.Lock()
+	defer lanPeersLock.Unlock()
+	lan := lanPeers[peerID]
+	if lan == nil || time.Since(lan.lastSeen) >= lanPeerExpiry {return nil}
+	return lan.addrs
+}
+
+// expireLanPeers forgets LAN peers mDNS has stopped finding
+func expireLanPeers(ctx context.Context, r *libp2pRelay) {
+	ticker := time.NewTicker(mdnsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var offline []string
+		lanPeersLock.Lock()
+		for peerID, lan := range lanPeers {
+			if time.Since(lan.lastSeen) < lanPeerExpiry {continue}
+			fmt.Println("LOST LAN PEER", peerID.Pretty())
+			delete(lanPeers, peerID)
+			if lan.online && r.host.Network().Connectedness(peerID) != network.Connected {
+				offline = append(offline, peerID.Pretty())
+			}
+		}
+		lanPeersLock.Unlock()
+		if len(offline) > 0 {
+			r.broadcast(&smsgPresenceChangeParams{nil, offline})
+		}
+	}
+}
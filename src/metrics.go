@@ -0,0 +1,147 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+
+package main
+
+/*
+# METRICS
+
+/metrics exports these for Prometheus, on the same port as /libp2p:
+
+```
+  websocket_clients                              -- clients, including detached ones
+  websocket_listeners{protocol}                  -- listeners
+  websocket_connections{protocol}                -- live connections to peers
+  websocket_bytes_total{protocol, direction}     -- bytes read from (in) and written to (out) peers
+  websocket_messages_total{direction, type}      -- control messages from clients (in) and to clients (out)
+  websocket_refusals_total{reason}               -- refused connections, see below
+  websocket_nat_status{status}                   -- 1 for the current NAT status, 0 for the others
+  websocket_svc_queue                            -- functions waiting for their svc goroutine
+```
+
+Protocols are named by clients, so only the first maxProtocolLabels protocols seen get their own
+protocol label and the rest share "other". This keeps a client from creating unlimited series.
+
+Refusal reasons are limit (a resource limit), acl (the listener's ACL), client (the client refused
+a Listener Request), timeout (a Listener Request was not answered), blocked (the blocklist),
+relay (a circuit this peer would not relay), and connect (a Connect that failed).
+*/
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	metricsNamespace  = "websocket"
+	maxProtocolLabels = 64
+)
+
+var protocolLabelsLock sync.Mutex
+var protocolLabels = make(map[string]bool) // protocols with their own label
+
+var (
+	metricClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "clients",
+		Help:      "Clients, including detached ones.",
+	})
+	metricListeners = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "listeners",
+		Help:      "Listeners by protocol.",
+	}, []string{"protocol"})
+	metricConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "connections",
+		Help:      "Live connections to peers by protocol.",
+	}, []string{"protocol"})
+	metricBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "bytes_total",
+		Help:      "Bytes read from and written to peers by protocol.",
+	}, []string{"protocol", "direction"})
+	metricMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_total",
+		Help:      "Control messages from and to clients by type.",
+	}, []string{"direction", "type"})
+	metricRefusals = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "refusals_total",
+		Help:      "Refused connections by reason.",
+	}, []string{"reason"})
+	metricNATStatus = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "nat_status",
+		Help:      "1 for the current NAT status, 0 for the others.",
+	}, []string{"status"})
+	metricSvcQueue = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "svc_queue",
+		Help:      "Functions waiting for their svc goroutine.",
+	})
+)
+
+func setNATStatusMetric(status network.Reachability) {
+	for _, s := range []network.Reachability{network.ReachabilityUnknown, network.ReachabilityPublic, network.ReachabilityPrivate} {
+		value := 0.0
+		if s == status {
+			value = 1
+		}
+		metricNATStatus.WithLabelValues(strings.ToLower(natStatus(s))).Set(value)
+	}
+}
+
+// protocolLabel returns the label for protocol, "other" once maxProtocolLabels protocols have labels
+func protocolLabel(protocol string) string {
+	protocolLabelsLock.Lock()
+	defer protocolLabelsLock.Unlock()
+	if protocolLabels[protocol] {return protocol}
+	if len(protocolLabels) >= maxProtocolLabels {return "other"}
+	protocolLabels[protocol] = true
+	return protocol
+}
+
+func countBytes(protocol string, direction string, n int) {
+	metricBytes.WithLabelValues(protocolLabel(protocol), direction).Add(float64(n))
+}
+
+// countMessage counts a control message, names is cmsgNames or smsgNames
+func countMessage(direction string, names []string, t messageType) {
+	name := "unknown"
+	if int(t) < len(names) {
+		name = names[t]
+	}
+	metricMessages.WithLabelValues(direction, name).Inc()
+}
+
+func countRefusal(reason string) {
+	metricRefusals.WithLabelValues(reason).Inc()
+}
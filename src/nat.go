@@ -0,0 +1,319 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+/*
+# NAT PORT MAPPING
+
+The relay finds the NAT gateway with a natDiscoverer, maps its TCP and QUIC ports on it, and
+renews the mappings every -natrenewal until it exits. Each renewal also checks the gateway's
+external address. When the address or a mapped port changes, the public addresses change with
+it. When renewals fail maxLeaseFailures times in a row the mapping counts as lost: the public
+addresses are withdrawn and the relay reports itself private, which clients see as Access
+Change, until a renewal succeeds again.
+
+The host picks up new public addresses through addPublicAddrs, its AddrsFactory, when its address
+loop next runs, within 5 seconds. Nothing can wake it sooner: the host is a RoutedHost, which
+hides the BasicHost's SignalAddressChange.
+
+Once ports are mapped, SIGINT and SIGTERM remove the mappings before exiting with status 1,
+giving up on the gateway after unmapTimeout.
+
+The -fakenat flag replaces the gateway with a simulated one (see fakenat.go) so all of this can
+be exercised without a NAT device.
+*/
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	nat "github.com/libp2p/go-nat"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+)
+
+const (
+	portMapDescription = "port for websocket peer"
+	maxLeaseFailures   = 3
+	unmapTimeout       = 5 * time.Second // how long to wait for the gateway when exiting
+)
+
+// natDiscoverer finds the NAT device that ports are mapped on
+type natDiscoverer interface {
+	discover(ctx context.Context, timeout time.Duration) (nat.NAT, error)
+}
+
+// gatewayDiscoverer finds real gateways with UPnP and NAT-PMP
+type gatewayDiscoverer struct{}
+
+var natDevices natDiscoverer = gatewayDiscoverer{}
+var natDiscoveryTimeout = 5 * time.Second
+var portMapRenewal = portMapLeaseTime - 5*time.Second // how often leases are renewed
+
+type portMapResult struct {
+	natter  nat.NAT
+	addr    net.TCPAddr
+	udpPort int // external port for QUIC, 0 if it could not be mapped
+	err     error
+}
+
+type portMapping struct {
+	protocol string
+	port     int
+	extPort  int
+}
+
+var portMappingsLock sync.Mutex
+var portMappingNAT nat.NAT
+var portMappings []portMapping // mappings to remove on exit
+var portMappingLost int32      // whether renewals are failing, use atomic ops
+var unmapOnExit sync.Once
+
+func (gatewayDiscoverer) discover(ctx context.Context, timeout time.Duration) (nat.NAT, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	natter, ok := <-nat.DiscoverNATs(ctx)
+	if !ok || natter == nil {return nil, nat.ErrNoNATFound}
+	return natter, nil
+}
+
+// publicAddrs returns the mapped TCP and QUIC addresses
+func publicAddrs() []ma.Multiaddr {
+	if atomic.LoadInt32(&portMappingLost) != 0 {return nil}
+	addr, _ := publicAddress.Load().(ma.Multiaddr)
+	if addr == nil {return nil}
+	addrs := []ma.Multiaddr{addr}
+	if udpPort := atomic.LoadInt32(&publicUDPPort); udpPort != 0 {
+		ip, err := manet.ToIP(addr)
+		if err == nil {
+			quic, err := manet.FromNetAddr(&net.UDPAddr{IP: ip, Port: int(udpPort)})
+			if err == nil {
+				addrs = append(addrs, quic.Encapsulate(ma.StringCast("/quic")))
+			}
+		}
+	}
+	return addrs
+}
+
+// addPublicAddrs is the host's AddrsFactory, it replaces the address with the same IP and
+// transport as each public address or adds the public address if there is none
+func addPublicAddrs(addrs []ma.Multiaddr) []ma.Multiaddr {
+	for _, public := range publicAddrs() {
+		ip, err := manet.ToIP(public)
+		if err != nil {continue}
+		replaced := false
+		for i, addr := range addrs {
+			addrIP, err := manet.ToIP(addr)
+			if err == nil && addrIP.Equal(ip) && transportName(addr) == transportName(public) {
+				addrs[i] = public // replace addr for same IP addr in case the port changed
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			addrs = append(addrs, public)
+		}
+	}
+	return addrs
+}
+
+// portMapped returns whether ports are mapped on a NAT gateway, in which case renewals keep the
+// public address current
+func portMapped() bool {
+	portMappingsLock.Lock()
+	defer portMappingsLock.Unlock()
+	return len(portMappings) > 0
+}
+
+// natReachability reports a public status as private while the port mapping is lost
+func natReachability(status network.Reachability) network.Reachability {
+	if status == network.ReachabilityPublic && atomic.LoadInt32(&portMappingLost) != 0 {
+		return network.ReachabilityPrivate
+	}
+	return status
+}
+
+func mapPort(ctx context.Context, port int) chan portMapResult {
+	result := make(chan portMapResult)
+	go func() {
+		fmt.Println("DISCOVERING NAT CONTROLLERS...")
+		natter, err := natDevices.discover(ctx, natDiscoveryTimeout)
+		if err != nil {
+			hasNat = false
+			fmt.Println("NO NAT MANAGER FOUND")
+			result <- portMapErr(err)
+			return
+		}
+		fmt.Println("FOUND NAT MANAGER:", natter.Type())
+		ip, err := natter.GetExternalAddress()
+		if err != nil {
+			result <- portMapErr(err)
+			return
+		}
+		fmt.Println("EXTERNAL ADDRESS:", ip)
+		extPort, err := natter.AddPortMapping("tcp", port, portMapDescription, portMapLeaseTime)
+		if err != nil {
+			result <- portMapErr(err)
+			return
+		}
+		fmt.Println("MAPPED PORT:", extPort)
+		mappings := []portMapping{{"tcp", port, extPort}}
+		udpPort, err := natter.AddPortMapping("udp", port, portMapDescription, portMapLeaseTime)
+		if err != nil {
+			fmt.Println("COULD NOT MAP UDP PORT FOR QUIC:", err)
+			udpPort = 0
+		} else {
+			fmt.Println("MAPPED UDP PORT:", udpPort)
+			mappings = append(mappings, portMapping{"udp", port, udpPort})
+		}
+		portMappingsLock.Lock()
+		portMappingNAT = natter
+		portMappings = append([]portMapping{}, mappings...)
+		portMappingsLock.Unlock()
+		unmapOnExit.Do(unmapPortsOnExit)
+		go renewPortMappings(ctx, natter, ip, mappings)
+		result <- portMapResult{natter, net.TCPAddr{IP: ip, Port: extPort, Zone: ""}, udpPort, nil}
+	}()
+	return result
+}
+
+// renewPortMappings renews the leases before they expire and follows changes to the external
+// address and ports
+func renewPortMappings(ctx context.Context, natter nat.NAT, ip net.IP, mappings []portMapping) {
+	failures := 0
+	changed := false // the public addresses need updating
+	ticker := time.NewTicker(portMapRenewal)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if newIP, err := natter.GetExternalAddress(); err == nil && !newIP.Equal(ip) {
+			fmt.Println("EXTERNAL ADDRESS CHANGED TO", newIP)
+			ip = newIP
+			changed = true
+		}
+		renewed := true
+		for i, mapping := range mappings {
+			extPort, err := natter.AddPortMapping(mapping.protocol, mapping.port, portMapDescription, portMapLeaseTime)
+			if err != nil {
+				fmt.Printf("COULD NOT RENEW %s PORT MAPPING FOR %d: %v\n", strings.ToUpper(mapping.protocol), mapping.port, err)
+				renewed = false
+			} else if extPort != mapping.extPort {
+				fmt.Printf("%s PORT %d IS NOW MAPPED TO %d\n", strings.ToUpper(mapping.protocol), mapping.port, extPort)
+				mappings[i].extPort = extPort
+				changed = true
+			}
+		}
+		if !renewed {
+			failures++
+			if failures == maxLeaseFailures {
+				fmt.Println("PORT MAPPING LOST")
+				atomic.StoreInt32(&portMappingLost, 1)
+				noteAddressChange()
+			}
+			continue
+		}
+		if failures >= maxLeaseFailures {
+			fmt.Println("PORT MAPPING RESTORED")
+			atomic.StoreInt32(&portMappingLost, 0)
+			changed = true
+		}
+		failures = 0
+		if changed {
+			setPublicAddrs(ip, mappings)
+			changed = false
+		}
+	}
+}
+
+// setPublicAddrs changes the public addresses to use ip and the mapped ports
+func setPublicAddrs(ip net.IP, mappings []portMapping) {
+	for _, mapping := range mappings {
+		switch mapping.protocol {
+		case "tcp":
+			addr, err := manet.FromNetAddr(&net.TCPAddr{IP: ip, Port: mapping.extPort})
+			if err != nil {
+				fmt.Println("BAD PUBLIC ADDRESS:", err)
+				continue
+			}
+			publicAddress.Store(addr)
+		case "udp":
+			atomic.StoreInt32(&publicUDPPort, int32(mapping.extPort))
+		}
+	}
+	noteAddressChange()
+}
+
+func portMapErr(err error) portMapResult {
+	return portMapResult{nil, net.TCPAddr{IP: net.IPv4zero, Port: 0, Zone: ""}, 0, err}
+}
+
+// unmapPorts removes the NAT port mappings instead of waiting for their leases to expire
+func unmapPorts() {
+	portMappingsLock.Lock()
+	defer portMappingsLock.Unlock()
+	for _, mapping := range portMappings {
+		if err := portMappingNAT.DeletePortMapping(mapping.protocol, mapping.port); err != nil {
+			fmt.Printf("COULD NOT REMOVE %s PORT MAPPING FOR %d: %v\n", strings.ToUpper(mapping.protocol), mapping.port, err)
+		} else {
+			fmt.Printf("REMOVED %s PORT MAPPING FOR %d\n", strings.ToUpper(mapping.protocol), mapping.port)
+		}
+	}
+	portMappings = nil
+}
+
+// unmapPortsOnExit removes the port mappings when the process is interrupted or terminated,
+// giving up on the gateway after unmapTimeout
+func unmapPortsOnExit() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fmt.Println("EXITING ON", sig)
+		unmapped := make(chan struct{})
+		go func() {
+			unmapPorts()
+			close(unmapped)
+		}()
+		select {
+		case <-unmapped:
+		case <-time.After(unmapTimeout):
+			fmt.Println("GAVE UP REMOVING PORT MAPPINGS")
+		}
+		os.Exit(1)
+	}()
+}
@@ -0,0 +1,198 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+)
+
+// fakeAutoNAT always reports the same status and address, like autonat between dial-backs
+type fakeAutoNAT struct {
+	status network.Reachability
+	addr   ma.Multiaddr // nil for none
+}
+
+func (a fakeAutoNAT) Status() network.Reachability {
+	return a.status
+}
+
+func (a fakeAutoNAT) PublicAddr() (ma.Multiaddr, error) {
+	if a.addr == nil {return nil, errors.New("no public address")}
+	return a.addr, nil
+}
+
+type natStep struct {
+	change   func(f *fakeNAT)     // changes the gateway before waiting
+	requests int                  // mapping requests the gateway must have seen
+	lost     bool                 // whether the mapping should count as lost
+	addr     string               // expected public TCP address, empty when withdrawn
+	udpPort  int32                // expected public QUIC port
+	access   network.Reachability // expected Access Change, ReachabilityUnknown for none
+}
+
+// In each test autonat keeps reporting the first mapped address, which must not replace the
+// address of a moved mapping
+
+func TestRenewPortMappings(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  string
+		steps []natStep
+	}{
+		{"renewal", "ip=203.0.113.1", []natStep{
+			{nil, 6, false, "/ip4/203.0.113.1/tcp/40000", 40001, network.ReachabilityUnknown},
+		}},
+		{"IP change", "ip=203.0.113.1", []natStep{
+			{func(f *fakeNAT) { f.externalIP = net.IPv4(203, 0, 113, 7).To4() }, 4, false, "/ip4/203.0.113.7/tcp/40000", 40001, network.ReachabilityUnknown},
+		}},
+		// every third request fails, so renewals never fail maxLeaseFailures times in a row
+		{"lease failure", "leasefail=3", []natStep{
+			{nil, 14, false, "/ip4/203.0.113.1/tcp/40000", 40001, network.ReachabilityUnknown},
+		}},
+		{"mapping loss", "ip=203.0.113.1", []natStep{
+			{loseMappings(time.Hour), 0, true, "", 40001, network.ReachabilityPrivate},
+			{func(f *fakeNAT) { f.outage = 0 }, 0, false, "/ip4/203.0.113.1/tcp/40002", 40003, network.ReachabilityPublic},
+		}},
+		{"mapping moved", "ip=203.0.113.1", []natStep{
+			{loseMappings(0), 0, false, "/ip4/203.0.113.1/tcp/40002", 40003, network.ReachabilityUnknown},
+		}},
+	}
+	oldRenewal, oldDevices := portMapRenewal, natDevices
+	defer func() { portMapRenewal, natDevices = oldRenewal, oldDevices }()
+	portMapRenewal = 5 * time.Millisecond
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, err := parseFakeNAT(test.spec)
+			if err != nil {t.Fatal(err)}
+			natDevices = fake
+			atomic.StoreInt32(&portMappingLost, 0)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			mapping := <-mapPort(ctx, 4001)
+			if mapping.err != nil {t.Fatal(mapping.err)}
+			addr, err := manet.FromNetAddr(&mapping.addr)
+			if err != nil {t.Fatal(err)}
+			publicAddress.Store(addr)
+			atomic.StoreInt32(&publicUDPPort, int32(mapping.udpPort))
+			an := fakeAutoNAT{network.ReachabilityPublic, addr}
+			r := testNATRelay(t, an)
+			for i, step := range test.steps {
+				select {
+				case <-addressChanges:
+				default:
+				}
+				if step.change != nil {
+					fake.lock.Lock()
+					step.change(fake)
+					fake.lock.Unlock()
+				}
+				waitForMapping(t, fake, step)
+				if step.addr != "" && step.addr != addr.String() {
+					select {
+					case <-addressChanges:
+					default:
+						t.Errorf("step %d: the reachability monitor was not woken for the new address", i)
+					}
+				}
+				if got := checkAccess(t, r, an); got != step.access {
+					t.Errorf("step %d: sent Access Change %s, want %s", i, natStatus(got), natStatus(step.access))
+				}
+				waitForMapping(t, fake, step) // the check must leave the mapped address alone
+			}
+		})
+	}
+}
+
+// loseMappings makes the gateway forget its mappings and refuse requests for outage
+func loseMappings(outage time.Duration) func(f *fakeNAT) {
+	return func(f *fakeNAT) {
+		f.lost = true
+		f.lostAt = time.Now()
+		f.outage = outage
+		f.mappings = make(map[string]int)
+	}
+}
+
+// waitForMapping waits until the renewals reach the step's expected state
+func waitForMapping(t *testing.T, fake *fakeNAT, step natStep) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		fake.lock.Lock()
+		requests := fake.requests
+		fake.lock.Unlock()
+		lost := atomic.LoadInt32(&portMappingLost) != 0
+		addr := ""
+		if addrs := publicAddrs(); len(addrs) > 0 {
+			addr = addrs[0].String()
+		}
+		udpPort := atomic.LoadInt32(&publicUDPPort)
+		if requests >= step.requests && lost == step.lost && addr == step.addr && udpPort == step.udpPort {return}
+		if time.Now().After(deadline) {
+			t.Fatalf("after %d requests: lost = %v, address = %q, QUIC port = %d, want lost = %v, address = %q, QUIC port = %d",
+				requests, lost, addr, udpPort, step.lost, step.addr, step.udpPort)
+		}
+		time.Sleep(portMapRenewal)
+	}
+}
+
+// testNATRelay returns a relay that autonat considers public and that has sent its first Access Change
+func testNATRelay(t *testing.T, an fakeAutoNAT) *libp2pRelay {
+	t.Helper()
+	r := &libp2pRelay{}
+	r.managementChan = make(chan func())
+	runSvc(r)
+	t.Cleanup(func() { close(r.managementChan) })
+	if got := checkAccess(t, r, an); got != network.ReachabilityPublic {
+		t.Fatalf("first Access Change is %s, want Public", natStatus(got))
+	}
+	return r
+}
+
+// checkAccess checks reachability the way the monitor does and returns the Access Change sent
+func checkAccess(t *testing.T, r *libp2pRelay, an fakeAutoNAT) network.Reachability {
+	t.Helper()
+	first := r.natStatus == network.ReachabilityUnknown
+	sent := make(chan network.Reachability, 1)
+	go func() {
+		select {
+		case status := <-accessChan:
+			sent <- status
+		case <-time.After(100 * time.Millisecond):
+			sent <- network.ReachabilityUnknown
+		}
+	}()
+	r.checkReachability(an, first)
+	return <-sent
+}
@@ -0,0 +1,90 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+)
+
+const (
+	findPeerTimeout = 30 * time.Second
+	pingTimeout     = 10 * time.Second
+)
+
+// gatherPeerInfo looks the peer up in the DHT if its addresses are unknown, pings it, and reports what the peerstore knows
+func gatherPeerInfo(pid peer.ID) *smsgPeerInfoParams {
+	h := conf.myHost
+	ps := h.Peerstore()
+	info := &smsgPeerInfoParams{peerID: pid.Pretty(), rtt: -1}
+	if len(ps.Addrs(pid)) == 0 && peerFinder != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), findPeerTimeout)
+		addrInfo, err := peerFinder.FindPeer(ctx, pid)
+		cancel()
+		if err != nil {
+			info.error = fmt.Sprintf("could not find peer: %v", err)
+		} else {
+			ps.AddAddrs(pid, addrInfo.Addrs, peerstore.TempAddrTTL)
+		}
+	}
+	if len(ps.Addrs(pid)) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+		result := <-ping.Ping(ctx, h, pid)
+		cancel()
+		if result.Error != nil {
+			info.error = fmt.Sprintf("ping failed: %v", result.Error)
+		} else {
+			info.rtt = int(result.RTT / time.Microsecond)
+		}
+	}
+	for _, addr := range ps.Addrs(pid) {
+		info.addrs = append(info.addrs, addr.String())
+	}
+	if protocols, err := ps.GetProtocols(pid); err == nil {
+		info.protocols = protocols
+	}
+	if agent, err := ps.Get(pid, "AgentVersion"); err == nil {
+		info.agentVersion, _ = agent.(string)
+	}
+	info.connectedness = h.Network().Connectedness(pid).String()
+	return info
+}
+
+func (c *libp2pClient) peerInfo(peerid string) error {
+	pid, err := peer.Decode(peerid)
+	if err != nil {return fmt.Errorf("error decoding peerID %s: %w", peerid, err)}
+	go func() {
+		info := gatherPeerInfo(pid)
+		svc(c, func() {
+			c.writeMsgpack(info)
+		})
+	}()
+	return nil
+}
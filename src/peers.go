@@ -0,0 +1,99 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+
+package main
+
+/*
+# CONNECTED PEERS
+
+The relay keeps every live connection to every peer in connectedPeers, from when the connection
+is created until CleanupClosed releases it. connectedPeers is only used in the relay's svc
+goroutine. ConnectedPeers answers with the whole registry: each peer with its connections'
+IDs, protocols, owning client and byte counts.
+*/
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// connectedPeerInfo is sent to clients in smsgConnectedPeers
+type connectedPeerInfo struct {
+	PeerID      string
+	Connections []peerConnectionInfo
+}
+
+type peerConnectionInfo struct {
+	ConnectionID uint64
+	Protocol     string
+	Client       uint64 // the number of the client that owns the connection
+	BytesIn      int64
+	BytesOut     int64
+}
+
+func (r *libp2pRelay) addConnectedPeer(con *libp2pConnection) {
+	cons := r.connectedPeers[con.peerID]
+	if cons == nil {
+		cons = make(map[*libp2pConnection]struct{})
+		r.connectedPeers[con.peerID] = cons
+	}
+	cons[con] = struct{}{}
+	metricConnections.WithLabelValues(protocolLabel(con.protocol)).Inc()
+}
+
+func (r *libp2pRelay) removeConnectedPeer(con *libp2pConnection) {
+	cons := r.connectedPeers[con.peerID]
+	if _, ok := cons[con]; !ok {return}
+	metricConnections.WithLabelValues(protocolLabel(con.protocol)).Dec()
+	delete(cons, con)
+	if len(cons) == 0 {
+		delete(r.connectedPeers, con.peerID)
+	}
+}
+
+// connectedPeerList returns the peers sorted by ID and their connections sorted by client and ID
+func (r *libp2pRelay) connectedPeerList() []connectedPeerInfo {
+	peers := make([]connectedPeerInfo, 0, len(r.connectedPeers))
+	for peerID, cons := range r.connectedPeers {
+		info := connectedPeerInfo{PeerID: peerID.Pretty()}
+		for con := range cons {
+			info.Connections = append(info.Connections, peerConnectionInfo{
+				con.id,
+				con.protocol,
+				con.client.number,
+				atomic.LoadInt64(&con.bytesIn),
+				atomic.LoadInt64(&con.bytesOut),
+			})
+		}
+		sort.Slice(info.Connections, func(i, j int) bool {
+			a, b := info.Connections[i], info.Connections[j]
+			return a.Client < b.Client || (a.Client == b.Client && a.ConnectionID < b.ConnectionID)
+		})
+		peers = append(peers, info)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].PeerID < peers[j].PeerID })
+	return peers
+}
+
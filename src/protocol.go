@@ -47,13 +47,39 @@ messages, with the first byte of each message identifying the command.
   Data:        [4][ID: 8][data: rest]         -- write data to stream
   Connect:     [5][FRAMES: 1][PROTOCOL: STR][RELAY: STR][PEERID: rest] -- connect to another peer (frames optional)
   Friends:     [6][ADD: []str][REMOVE: []str] -- alter friend list
+  ListFriends: [7]                            -- request the friend list
+  FriendInfo:  [8][PEERID: str][NICKNAME: str][TRUST: int] -- set a friend's nickname and trust level
+  CreateInvite: [9][VALIDFOR: int][ONETIME: 1] -- create a signed invitation valid for VALIDFOR seconds
+  AcceptInvite: [10][INVITE: str]             -- verify an invitation and add the inviter as a friend
+  ListenerACL: [11][PROTOCOL: str][MODE: int][PEERS: []str] -- restrict who may connect to PROTOCOL
+  ListenerResponse: [12][ID: str][ACCEPT: 1]  -- accept or refuse a Listener Request
+  Block:       [13][ADD: []str][REMOVE: []str] -- alter the blocklist of peer IDs, IPs and CIDR ranges
+  ListBlocked: [14]                           -- request the blocklist
+  ListenMode:  [15][PROTOCOL: str][MODE: int] -- route streams for a protocol shared with other clients
+                                                 0: round robin, 1: first responder, 2: fan out
+  Subscribe:   [16][TOPIC: str][FRIENDSONLY: 1] -- receive pubsub messages for TOPIC
+  Unsubscribe: [17][TOPIC: str]               -- stop receiving messages for TOPIC
+  Publish:     [18][TOPIC: str][DATA: rest]   -- publish DATA to TOPIC
+  Advertise:   [19][NAMESPACE: str]           -- advertise this peer under NAMESPACE until stopped
+  StopAdvertising: [20][NAMESPACE: str]       -- stop advertising under NAMESPACE
+  FindPeers:   [21][NAMESPACE: str][LIMIT: int] -- find peers advertising NAMESPACE, 0 for no limit
+  PeerInfo:    [22][PEERID: str]              -- look up and ping a peer, answered with Peer Info
+  ConnectedPeers: [23]                        -- request the live connections to each peer
 ```
 
+ListenerACL modes are 0: open (default), 1: friends only, 2: only PEERS, 3: all but PEERS,
+4: ask the client with a Listener Request before any Listener Connection. ListenerACL can be sent
+before Listen so no stream is accepted before the ACL is in place.
+
+Connect's PEERID may also be a signed /invite/ bundle, which is verified before connecting.
+Connecting with an invitation accepts it as AcceptInvite does, unless the inviter is already
+a friend.
+
 # SERVER-TO-CLIENT MESSAGES
 
 ```
   Hello:                   [0][STARTED: 1] -- hello message indicates whether the peer needs starting
-  Identify:                [1][PUBLIC: 1][PEERID: str][ADDRESSES: str][KEY: rest] -- successful initialization
+  Identify:                [1][PUBLIC: 1][PEERID: str][ADDRESSES: str][KEY: rest][SESSION: str][RESUMED: 1] -- successful initialization
   Listener Connection:     [2][ID: 8][PEERID: str][PROTOCOL: rest] -- new listener connection with id ID
   Connection Closed:       [3][ID: 8][REASON: rest]            -- connection ID closed
   Data:                    [4][ID: 8][data: rest]              -- receive data from stream with id ID
@@ -65,8 +91,32 @@ messages, with the first byte of each message identifying the command.
   Listening:               [10][PROTOCOL: rest]                -- confirmation that listening has started
   Access Change:           [11][PUBLIC: 1]                     -- peer access has changed
   Presence Change:         [12][ONLINE: []str][OFFLINE: []str] -- peer access has changed
+  Friend List:             [13][FRIENDS: []{PeerID, Nickname, LastSeen, Addrs, Trust}] -- stored friends
+  Invite:                  [14][INVITE: str]                   -- a signed invitation to this peer
+  Invite Accepted:         [15][PEERID: str][TREENAME: str]    -- the inviter is now a friend
+  Listener Request:        [16][ID: str][PEERID: str][PROTOCOL: str] -- PEERID wants to connect, answer with ListenerResponse
+  Block List:              [17][ENTRIES: []str]                -- blocked peer IDs and IP ranges
+  Limit Exceeded:          [18][PEERID: str][PROTOCOL: str][REASON: str] -- refused a stream from PEERID because of a resource limit
+  Topic Message:           [19][TOPIC: str][PEERID: str][DATA: bytes] -- a pubsub message PEERID published to TOPIC
+  Peer Found:              [20][NAMESPACE: str][PEERID: str][ADDRS: []str] -- FindPeers found a peer
+  Find Peers Done:         [21][NAMESPACE: str]                -- FindPeers finished
+  LAN Peer:                [22][PEERID: str][ADDRS: []str]     -- mDNS found a peer on the local network
+  Peer Info:               [23][PEERID: str][ADDRS: []str][PROTOCOLS: []str][AGENT: str][CONNECTEDNESS: str][RTT: int][ERROR: str]
+                                                               -- answer to PeerInfo, RTT is in microseconds or -1 if ping failed
+  Connection Status:       [24][CONID: str][PEERID: str][ADDR: str][TRANSPORT: str][DIRECTION: str][SECURITY: str][RELAYED: 1][DIRECTADDR: str]
+                                                               -- the libp2p connection under a stream, sent after Peer Connection and
+                                                               -- Listener Connection and again with DIRECTADDR when a relayed peer connects directly
+  Relay Status:            [25][ACTIVE: 1][SLOTS: int][CIRCUITS: int] -- whether this peer is relaying circuits for friends
+  Addresses Changed:       [26][ADDRESSES: []str]              -- this peer's addresses changed
+  Connected Peers:         [27][PEERS: []{PeerID, Connections: []{ConnectionID, Protocol, Client, BytesIn, BytesOut}}]
+                                                               -- answer to ConnectedPeers, Client numbers the owning client
 ```
 
+SESSION in Identify is a token for resuming the client. When the websocket closes, the relay keeps
+the client's listeners and connections for a grace period and buffers messages for it. A new websocket
+opened with /libp2p?session=SESSION within that period takes over the client under the same connection
+IDs, receives Identify with RESUMED set, and then receives the buffered messages.
+
 This code uses quite a few goroutines and channels. Here is the pattern:
 
 1) structs which implement the chanSvc interface use a channel to receive functions to execute within a single svc goroutine
@@ -78,7 +128,9 @@ This code uses quite a few goroutines and channels. Here is the pattern:
 */
 
 import (
+	crand "crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"net"
@@ -89,6 +141,7 @@ import (
 	"errors"
 	"io"
 	"math/rand"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -96,6 +149,7 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/libp2p/go-libp2p-core/network"
 	packet "github.com/zot/textcraft-packet"
+	"golang.org/x/time/rate"
 )
 
 type messageType byte
@@ -108,6 +162,23 @@ const (
 	cmsgData
 	cmsgConnect
 	cmsgFriends
+	cmsgListFriends
+	cmsgFriendInfo
+	cmsgCreateInvite
+	cmsgAcceptInvite
+	cmsgListenerACL
+	cmsgListenerResponse
+	cmsgBlock
+	cmsgListBlocked
+	cmsgListenMode
+	cmsgSubscribe
+	cmsgUnsubscribe
+	cmsgPublish
+	cmsgAdvertise
+	cmsgStopAdvertising
+	cmsgFindPeers
+	cmsgPeerInfo
+	cmsgConnectedPeers
 )
 
 type cmsgStartParams struct {
@@ -140,6 +211,69 @@ type cmsgFriendsParams struct {
 	remove []string
 }
 
+type cmsgFriendInfoParams struct {
+	peerID   string
+	nickname string
+	trust    int
+}
+
+type cmsgCreateInviteParams struct {
+	validFor int
+	oneTime  bool
+}
+
+type cmsgAcceptInviteParams struct {
+	invite string
+}
+
+type cmsgListenerACLParams struct {
+	protocol string
+	mode     int
+	peers    []string
+}
+
+type cmsgListenerResponseParams struct {
+	conID  string
+	accept bool
+}
+
+type cmsgListenModeParams struct {
+	protocol string
+	mode     int
+}
+
+type cmsgSubscribeParams struct {
+	topic       string
+	friendsOnly bool
+}
+
+type cmsgUnsubscribeParams struct {
+	topic string
+}
+
+type cmsgPublishParams struct {
+	topic string
+	data  []byte
+}
+
+type cmsgNamespaceParams struct {
+	namespace string
+}
+
+type cmsgFindPeersParams struct {
+	namespace string
+	limit     int
+}
+
+type cmsgPeerInfoParams struct {
+	peerID string
+}
+
+type cmsgBlockParams struct {
+	add    []string
+	remove []string
+}
+
 const (
 	smsgHello messageType = iota
 	smsgIdent
@@ -154,6 +288,21 @@ const (
 	smsgListening
 	smsgAccessChange
 	smsgPresenceChange
+	smsgFriendList
+	smsgInvite
+	smsgInviteAccepted
+	smsgListenerRequest
+	smsgBlockList
+	smsgLimitExceeded
+	smsgTopicMessage
+	smsgPeerFound
+	smsgFindPeersDone
+	smsgLanPeer
+	smsgPeerInfo
+	smsgConnectionStatus
+	smsgRelayStatus
+	smsgAddressesChanged
+	smsgConnectedPeers
 )
 
 type smsgHelloParams struct {
@@ -167,6 +316,8 @@ type smsgIdentParams struct {
 	addresses      []string
 	peerKey        string
 	currentVersion string
+	sessionToken   string
+	resumed        bool
 }
 type smsgListenerConnectionParams struct {
 	conID    string
@@ -211,6 +362,76 @@ type smsgPresenceChangeParams struct {
 	online  []string
 	offline []string
 }
+type smsgFriendListParams struct {
+	friends []friendInfo
+}
+type smsgInviteParams struct {
+	invite string
+}
+type smsgInviteAcceptedParams struct {
+	peerID   string
+	treeName string
+}
+type smsgListenerRequestParams struct {
+	conID    string
+	peerID   string
+	protocol string
+}
+type smsgBlockListParams struct {
+	entries []string
+}
+type smsgLimitExceededParams struct {
+	peerID   string
+	protocol string
+	reason   string
+}
+type smsgTopicMessageParams struct {
+	topic  string
+	peerID string
+	data   []byte
+}
+type smsgPeerFoundParams struct {
+	namespace string
+	peerID    string
+	addrs     []string
+}
+type smsgFindPeersDoneParams struct {
+	namespace string
+}
+type smsgLanPeerParams struct {
+	peerID string
+	addrs  []string
+}
+type smsgPeerInfoParams struct {
+	peerID        string
+	addrs         []string
+	protocols     []string
+	agentVersion  string
+	connectedness string
+	rtt           int // microseconds, -1 if ping failed
+	error         string
+}
+type smsgConnectionStatusParams struct {
+	conID      string
+	peerID     string
+	addr       string // remote multiaddr
+	transport  string // tcp, quic, websocket, or relay
+	direction  string // Inbound or Outbound
+	security   string // tls or secio
+	relayed    bool
+	directAddr string // a direct connection to the peer that new streams will use
+}
+type smsgRelayStatusParams struct {
+	active   bool
+	slots    int
+	circuits int
+}
+type smsgAddressesChangedParams struct {
+	addresses []string
+}
+type smsgConnectedPeersParams struct {
+	peers []connectedPeerInfo
+}
 
 type messageParams interface{ msgType() messageType }
 
@@ -227,9 +448,24 @@ func (smsg smsgErrorParams) msgType() messageType                 { return smsgE
 func (smsg smsgListeningParams) msgType() messageType             { return smsgListening }
 func (smsg smsgAccessChangeParams) msgType() messageType          { return smsgAccessChange }
 func (smsg smsgPresenceChangeParams) msgType() messageType        { return smsgPresenceChange }
-
-var cmsgNames = [...]string{"cmsgStart", "cmsgListen", "cmsgStop", "cmsgClose", "cmsgData", "cmsgConnect", "cmsgFriends"}
-var smsgNames = [...]string{"smsgHello", "smsgIdent", "smsgNewConnection", "smsgConnectionClosed", "smsgData", "smsgListenRefused", "smsgListenerClosed", "smsgPeerConnection", "smsgPeerConnectionRefused", "smsgError", "smsgListening", "smsgAccessChange", "smsgPresenceChange"}
+func (smsg smsgFriendListParams) msgType() messageType            { return smsgFriendList }
+func (smsg smsgInviteParams) msgType() messageType                { return smsgInvite }
+func (smsg smsgInviteAcceptedParams) msgType() messageType        { return smsgInviteAccepted }
+func (smsg smsgListenerRequestParams) msgType() messageType       { return smsgListenerRequest }
+func (smsg smsgBlockListParams) msgType() messageType             { return smsgBlockList }
+func (smsg smsgLimitExceededParams) msgType() messageType         { return smsgLimitExceeded }
+func (smsg smsgTopicMessageParams) msgType() messageType          { return smsgTopicMessage }
+func (smsg smsgPeerFoundParams) msgType() messageType             { return smsgPeerFound }
+func (smsg smsgFindPeersDoneParams) msgType() messageType         { return smsgFindPeersDone }
+func (smsg smsgLanPeerParams) msgType() messageType               { return smsgLanPeer }
+func (smsg smsgPeerInfoParams) msgType() messageType              { return smsgPeerInfo }
+func (smsg smsgConnectionStatusParams) msgType() messageType      { return smsgConnectionStatus }
+func (smsg smsgRelayStatusParams) msgType() messageType           { return smsgRelayStatus }
+func (smsg smsgAddressesChangedParams) msgType() messageType      { return smsgAddressesChanged }
+func (smsg smsgConnectedPeersParams) msgType() messageType        { return smsgConnectedPeers }
+
+var cmsgNames = [...]string{"cmsgStart", "cmsgListen", "cmsgStop", "cmsgClose", "cmsgData", "cmsgConnect", "cmsgFriends", "cmsgListFriends", "cmsgFriendInfo", "cmsgCreateInvite", "cmsgAcceptInvite", "cmsgListenerACL", "cmsgListenerResponse", "cmsgBlock", "cmsgListBlocked", "cmsgListenMode", "cmsgSubscribe", "cmsgUnsubscribe", "cmsgPublish", "cmsgAdvertise", "cmsgStopAdvertising", "cmsgFindPeers", "cmsgPeerInfo", "cmsgConnectedPeers"}
+var smsgNames = [...]string{"smsgHello", "smsgIdent", "smsgNewConnection", "smsgConnectionClosed", "smsgData", "smsgListenRefused", "smsgListenerClosed", "smsgPeerConnection", "smsgPeerConnectionRefused", "smsgError", "smsgListening", "smsgAccessChange", "smsgPresenceChange", "smsgFriendList", "smsgInvite", "smsgInviteAccepted", "smsgListenerRequest", "smsgBlockList", "smsgLimitExceeded", "smsgTopicMessage", "smsgPeerFound", "smsgFindPeersDone", "smsgLanPeer", "smsgPeerInfo", "smsgConnectionStatus", "smsgRelayStatus", "smsgAddressesChanged", "smsgConnectedPeers"}
 
 const (
 	maxMessageSize = 65536 // Maximum websocket message size
@@ -237,12 +473,15 @@ const (
 	maxPort        = 65535
 	pongWait       = 60 * time.Second
 	pingPeriod     = pongWait * 9 / 10
+	maxBacklog     = 4 * 1024 * 1024 // Maximum bytes buffered for a detached client
 	verboseSvc     = false
 	//verboseSvc = true
 )
 
 var frameLength = []byte{0, 0, 0, 0}
 var svcCount int32
+var clientCount uint64 // numbers clients, use atomic ops
+var sessionGrace = 30 * time.Second // how long a detached client waits for a new websocket
 
 var (
 	upgrader = websocket.Upgrader{
@@ -286,11 +525,15 @@ type connection struct {
 	name         string
 	protocol     string
 	data         interface{}
+	limiters     []*rate.Limiter // bandwidth limits for reads and writes
+	bytesIn      int64           // bytes read from the stream, use atomic ops
+	bytesOut     int64           // bytes written to the stream, use atomic ops
 }
 
 // client allows a browser to use the relay
 type client struct {
 	nextConnectionID uint64
+	number           uint64          // identifies the client in status reports, immutable
 	control          *websocket.Conn // the client's control websocket
 	managementChan   chan func()     // client management
 	running          bool
@@ -298,12 +541,19 @@ type client struct {
 	transferChan     chan bool
 	relay            *relay
 	data             interface{}
-	ticker           *time.Ticker
 	access           network.Reachability
+	session          string     // token a new websocket presents to resume this client
+	sessionLock      sync.Mutex // protects detached, resuming, backlog, and backlogSize
+	sessionGen       int        // counts detaches so an old grace timer does not close a resumed client
+	detached         bool       // the websocket closed, messages are buffered until one resumes the session
+	resuming         bool       // a websocket claimed the detached session and is attaching
+	backlog          [][]byte   // messages buffered while detached
+	backlogSize      int
 }
 
 type relay struct {
 	clients        map[*websocket.Conn]*client // id -> client
+	sessions       map[string]*client          // session token -> client
 	managementChan chan func()                 // client creation
 	handler        protocolHandler
 	peerID         string
@@ -324,6 +574,23 @@ type protocolHandler interface {
 	Data(c *client, conID uint64, data []byte)
 	Connect(c *client, protocol string, peerID string, frames bool, relay bool)
 	Friends(add []string, remove []string) error
+	ListFriends(c *client)
+	FriendInfo(peerID string, nickname string, trust int) error
+	CreateInvite(c *client, validFor int, oneTime bool)
+	AcceptInvite(c *client, invite string)
+	ListenerACL(c *client, protocol string, mode int, peers []string) error
+	ListenerResponse(c *client, conID uint64, accept bool)
+	Block(add []string, remove []string) error
+	ListBlocked(c *client)
+	ListenMode(c *client, protocol string, mode int) error
+	Subscribe(c *client, topic string, friendsOnly bool) error
+	Unsubscribe(c *client, topic string)
+	Publish(c *client, topic string, data []byte) error
+	Advertise(c *client, namespace string) error
+	StopAdvertising(c *client, namespace string)
+	FindPeers(c *client, namespace string, limit int) error
+	PeerInfo(c *client, peerID string) error
+	ConnectedPeers(c *client)
 	CleanupClosed(c *connection)
 	AddressesJson() string
 	AddressArray() []string
@@ -354,7 +621,9 @@ func svcSync(s chanSvc, code func() interface{}) interface{} {
 }
 
 func svc(s chanSvc, code func()) {
+	metricSvcQueue.Inc()
 	go func() { // using a goroutine so the channel won't block
+		defer metricSvcQueue.Dec()
 		if verboseSvc {
 			count := atomic.AddInt32(&svcCount, 1)
 			fmt.Printf("@@ QUEUE SVC %d\n", count)
@@ -425,6 +694,9 @@ func (c *connection) init(name string, protocol string, conID uint64, con twoWay
 		name,
 		protocol,
 		data,
+		nil,
+		0,
+		0,
 	}
 	runSvc(c)
 }
@@ -440,6 +712,9 @@ func (c *connection) writeData(r *relay, data []byte) {
 		copy(c.writeBuf[offset:], data)
 		c.transferChan <- true // done with data
 		data = c.writeBuf[0 : len(data)+offset]
+		throttle(c.limiters, len(data))
+		atomic.AddInt64(&c.bytesOut, int64(len(data)))
+		countBytes(c.protocol, "out", len(data))
 		for len(data) > 0 {
 			c.stream.SetWriteDeadline(time.Unix(0, 0))
 			len, err := c.stream.Write(data)
@@ -456,7 +731,9 @@ func (c *connection) writeData(r *relay, data []byte) {
 					fmt.Println("ERROR WRITING DATA TO STREAM", err)
 				}
 				svc(c.client, func() {
-					c.client.control.WriteMessage(websocket.CloseMessage, make([]byte, 0))
+					if c.client.control != nil {
+						c.client.control.WriteMessage(websocket.CloseMessage, make([]byte, 0))
+					}
 					log.Printf("error: %v\n", err)
 					r.Close(c.client, c.id)
 				})
@@ -487,6 +764,10 @@ func (c *client) init(r *relay, data interface{}) {
 	c.relay = r
 	c.data = data
 	c.running = true
+	c.number = atomic.AddUint64(&clientCount, 1)
+	token := make([]byte, 16)
+	crand.Read(token)
+	c.session = hex.EncodeToString(token)
 }
 
 func (c *client) getSvcChannel() chan func() {
@@ -556,6 +837,7 @@ func (c *client) readWebsocket(r *relay) {
 			}
 			if err == nil {
 				fmt.Printf("@@@ READ MESSAGE %s: %X\n", messageType(data[0]).clientName(), data[1:])
+				countMessage("in", cmsgNames[:], messageType(data[0]))
 			} else {
 				fmt.Println("ERROR READING WEB SOCKET", err)
 				break
@@ -606,6 +888,117 @@ func (c *client) readWebsocket(r *relay) {
 						if err == nil {
 							err = r.Friends(msg.add, msg.remove)
 						}
+					case cmsgListFriends:
+						r.ListFriends(c)
+					case cmsgFriendInfo:
+						msg := new(cmsgFriendInfoParams)
+						_, unmarshalErr := packet.Unmarshal(data[1:], msg)
+						if c.assert(unmarshalErr == nil && len(msg.peerID) > 0, "Bad message format for cmsgFriendInfo") {
+							if infoErr := r.FriendInfo(msg.peerID, msg.nickname, msg.trust); infoErr != nil {
+								c.error(infoErr.Error())
+							} else {
+								r.ListFriends(c)
+							}
+						}
+					case cmsgCreateInvite:
+						msg := new(cmsgCreateInviteParams)
+						_, unmarshalErr := packet.Unmarshal(data[1:], msg)
+						if c.assert(unmarshalErr == nil, "Bad message format for cmsgCreateInvite") {
+							r.CreateInvite(c, msg.validFor, msg.oneTime)
+						}
+					case cmsgAcceptInvite:
+						msg := new(cmsgAcceptInviteParams)
+						_, unmarshalErr := packet.Unmarshal(data[1:], msg)
+						if c.assert(unmarshalErr == nil && len(msg.invite) > 0, "Bad message format for cmsgAcceptInvite") {
+							r.AcceptInvite(c, msg.invite)
+						}
+					case cmsgListenerACL:
+						msg := new(cmsgListenerACLParams)
+						_, unmarshalErr := packet.Unmarshal(data[1:], msg)
+						if c.assert(unmarshalErr == nil && len(msg.protocol) > 0, "Bad message format for cmsgListenerACL") {
+							if aclErr := r.ListenerACL(c, msg.protocol, msg.mode, msg.peers); aclErr != nil {
+								c.error(aclErr.Error())
+							}
+						}
+					case cmsgListenerResponse:
+						msg := new(cmsgListenerResponseParams)
+						_, unmarshalErr := packet.Unmarshal(data[1:], msg)
+						if c.assert(unmarshalErr == nil, "Bad message format for cmsgListenerResponse") {
+							conID, parseErr := strconv.ParseUint(msg.conID, 10, 64)
+							if c.assert(parseErr == nil, "Bad connection id for cmsgListenerResponse") {
+								r.ListenerResponse(c, conID, msg.accept)
+							}
+						}
+					case cmsgBlock:
+						msg := new(cmsgBlockParams)
+						_, unmarshalErr := packet.Unmarshal(data[1:], msg)
+						if c.assert(unmarshalErr == nil, "Bad message format for cmsgBlock") {
+							if blockErr := r.Block(msg.add, msg.remove); blockErr != nil {
+								c.error(blockErr.Error())
+							} else {
+								r.ListBlocked(c)
+							}
+						}
+					case cmsgListBlocked:
+						r.ListBlocked(c)
+					case cmsgListenMode:
+						msg := new(cmsgListenModeParams)
+						_, unmarshalErr := packet.Unmarshal(data[1:], msg)
+						if c.assert(unmarshalErr == nil && len(msg.protocol) > 0, "Bad message format for cmsgListenMode") {
+							if modeErr := r.ListenMode(c, msg.protocol, msg.mode); modeErr != nil {
+								c.error(modeErr.Error())
+							}
+						}
+					case cmsgSubscribe:
+						msg := new(cmsgSubscribeParams)
+						_, unmarshalErr := packet.Unmarshal(data[1:], msg)
+						if c.assert(unmarshalErr == nil && len(msg.topic) > 0, "Bad message format for cmsgSubscribe") {
+							if subErr := r.Subscribe(c, msg.topic, msg.friendsOnly); subErr != nil {
+								c.error(subErr.Error())
+							}
+						}
+					case cmsgUnsubscribe:
+						msg := new(cmsgUnsubscribeParams)
+						_, unmarshalErr := packet.Unmarshal(data[1:], msg)
+						if c.assert(unmarshalErr == nil && len(msg.topic) > 0, "Bad message format for cmsgUnsubscribe") {
+							r.Unsubscribe(c, msg.topic)
+						}
+					case cmsgPublish:
+						msg := new(cmsgPublishParams)
+						_, unmarshalErr := packet.Unmarshal(data[1:], msg)
+						if c.assert(unmarshalErr == nil && len(msg.topic) > 0, "Bad message format for cmsgPublish") {
+							if pubErr := r.Publish(c, msg.topic, msg.data); pubErr != nil {
+								c.error(pubErr.Error())
+							}
+						}
+					case cmsgAdvertise, cmsgStopAdvertising:
+						msg := new(cmsgNamespaceParams)
+						_, unmarshalErr := packet.Unmarshal(data[1:], msg)
+						if c.assert(unmarshalErr == nil && len(msg.namespace) > 0, "Bad message format for "+msgType.clientName()) {
+							if msgType == cmsgStopAdvertising {
+								r.StopAdvertising(c, msg.namespace)
+							} else if adErr := r.Advertise(c, msg.namespace); adErr != nil {
+								c.error(adErr.Error())
+							}
+						}
+					case cmsgFindPeers:
+						msg := new(cmsgFindPeersParams)
+						_, unmarshalErr := packet.Unmarshal(data[1:], msg)
+						if c.assert(unmarshalErr == nil && len(msg.namespace) > 0, "Bad message format for cmsgFindPeers") {
+							if findErr := r.FindPeers(c, msg.namespace, msg.limit); findErr != nil {
+								c.error(findErr.Error())
+							}
+						}
+					case cmsgPeerInfo:
+						msg := new(cmsgPeerInfoParams)
+						_, unmarshalErr := packet.Unmarshal(data[1:], msg)
+						if c.assert(unmarshalErr == nil && len(msg.peerID) > 0, "Bad message format for cmsgPeerInfo") {
+							if infoErr := r.PeerInfo(c, msg.peerID); infoErr != nil {
+								c.error(infoErr.Error())
+							}
+						}
+					case cmsgConnectedPeers:
+						r.ConnectedPeers(c)
 					}
 				}
 				if err != nil {
@@ -617,7 +1010,7 @@ func (c *client) readWebsocket(r *relay) {
 		}
 		fmt.Println("@@@\n@@@ DONE READING WEB SOCKET\n@@@")
 		svc(r, func() {
-			r.CloseClient(c)
+			r.detachClient(c)
 		})
 	}()
 }
@@ -661,6 +1054,9 @@ func (c *client) readStreamFrames(con *connection) {
 				err = reallyReadFull(con.stream, body[:len])
 			}
 			if err == nil {
+				throttle(con.limiters, int(len)+4)
+				atomic.AddInt64(&con.bytesIn, int64(len)+4)
+				countBytes(con.protocol, "in", int(len)+4)
 				fmt.Printf("RECEIVED %d BYTES: %X\n", len, con.readBuf[:len])
 				//fmt.Printf("RECEIVED %d BYTES: %X\n", len, con.readBuf[:9+len])
 			}
@@ -706,6 +1102,9 @@ func (c *client) readStreamData(con *connection) {
 					con.cleanup()
 				})
 			} else {
+				throttle(con.limiters, len)
+				atomic.AddInt64(&con.bytesIn, int64(len))
+				countBytes(con.protocol, "in", len)
 				fmt.Printf("RECEIVED %d BYTES: %X\n", len, con.readBuf[0:len])
 				c.receiveFrame(con, con.readBuf[0:len], err)
 				//fmt.Printf("RECEIVED %d BYTES: %X\n", len, con.readBuf[0:9+len])
@@ -751,6 +1150,7 @@ func putString(buf []byte, str string) []byte {
 }
 
 func (c *client) writeMsgpack(msg messageParams) error {
+	if c.buffered(msg) {return nil}
 	return c.closeOnError(func() error {
 		return writeMsgpack(c.control, msg)
 	})
@@ -779,17 +1179,84 @@ func (c *client) closeOnError(code func() error) error {
 }
 
 func writeMsgpack(ws *websocket.Conn, msg messageParams) error {
-	data, err := packet.Marshal(msg)
+	packet, err := encodeMsgpack(msg)
 	if err == nil {
-		packet := make([]byte, len(data)+1)
-		packet[0] = byte(msg.msgType())
-		copy(packet[1:], data)
 		err = ws.WriteMessage(websocket.BinaryMessage, packet)
 	}
 	return err
 }
 
+func encodeMsgpack(msg messageParams) ([]byte, error) {
+	data, err := packet.Marshal(msg)
+	if err != nil {return nil, err}
+	packet := make([]byte, len(data)+1)
+	packet[0] = byte(msg.msgType())
+	countMessage("out", smsgNames[:], msg.msgType())
+	copy(packet[1:], data)
+	return packet, nil
+}
+
+// buffered saves msg for the next websocket if the client is detached
+func (c *client) buffered(msg messageParams) bool {
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+	if !c.detached {return false}
+	packet, err := encodeMsgpack(msg)
+	if err != nil {return true}
+	c.backlogSize += len(packet)
+	if c.backlogSize > maxBacklog {
+		if c.backlogSize-len(packet) <= maxBacklog {
+			fmt.Printf("SESSION %s BUFFERED TOO MUCH, CLOSING\n", c.session)
+			c.backlog = nil
+			svc(c.relay, func() {
+				c.relay.CloseClient(c)
+			})
+		}
+		return true
+	}
+	c.backlog = append(c.backlog, packet)
+	return true
+}
+
+func (c *client) isDetached() bool {
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+	return c.detached
+}
+
+// claimSession marks a detached client as resuming, returning false if it is attached or another
+// websocket already claimed it
+func (c *client) claimSession() bool {
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+	if !c.detached || c.resuming {return false}
+	c.resuming = true
+	return true
+}
+
+// watchWebsocket starts the ping/pong keepalive for con
+func (c *client) watchWebsocket(con *websocket.Conn) {
+	con.SetReadDeadline(time.Now().Add(pongWait))
+	con.SetPongHandler(func(string) error { con.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	go func() {
+		ticker := time.NewTicker(pingPeriod)
+		defer ticker.Stop()
+		for range ticker.C {
+			stop := svcSync(c, func() interface{} {
+				if c.control != con {return true} // detached or resumed on another websocket
+				if err := con.WriteMessage(websocket.PingMessage, nil); err != nil {
+					c.close()
+					return true
+				}
+				return false
+			})
+			if stop.(bool) {return}
+		}
+	}()
+}
+
 func (c *client) connectionRefused(err error, peerid string, protocol string) {
+	countRefusal("connect")
 	c.writeMsgpack(&smsgPeerConnectionRefusedParams{peerid, protocol, err.Error()})
 }
 
@@ -889,16 +1356,101 @@ func (r *relay) Friends(add []string, remove []string) error {
 	return r.handler.Friends(add, remove)
 }
 
+func (r *relay) ListFriends(c *client) {
+	r.handler.ListFriends(c)
+}
+
+func (r *relay) FriendInfo(peerID string, nickname string, trust int) error {
+	return r.handler.FriendInfo(peerID, nickname, trust)
+}
+
+func (r *relay) CreateInvite(c *client, validFor int, oneTime bool) {
+	r.handler.CreateInvite(c, validFor, oneTime)
+}
+
+func (r *relay) AcceptInvite(c *client, invite string) {
+	r.handler.AcceptInvite(c, invite)
+}
+
+func (r *relay) ListenerACL(c *client, protocol string, mode int, peers []string) error {
+	return r.handler.ListenerACL(c, protocol, mode, peers)
+}
+
+func (r *relay) ListenerResponse(c *client, conID uint64, accept bool) {
+	r.handler.ListenerResponse(c, conID, accept)
+}
+
+func (r *relay) Block(add []string, remove []string) error {
+	return r.handler.Block(add, remove)
+}
+
+func (r *relay) ListBlocked(c *client) {
+	r.handler.ListBlocked(c)
+}
+
+func (r *relay) ListenMode(c *client, protocol string, mode int) error {
+	return r.handler.ListenMode(c, protocol, mode)
+}
+
+func (r *relay) Subscribe(c *client, topic string, friendsOnly bool) error {
+	return r.handler.Subscribe(c, topic, friendsOnly)
+}
+
+func (r *relay) Unsubscribe(c *client, topic string) {
+	r.handler.Unsubscribe(c, topic)
+}
+
+func (r *relay) Publish(c *client, topic string, data []byte) error {
+	return r.handler.Publish(c, topic, data)
+}
+
+func (r *relay) Advertise(c *client, namespace string) error {
+	return r.handler.Advertise(c, namespace)
+}
+
+func (r *relay) StopAdvertising(c *client, namespace string) {
+	r.handler.StopAdvertising(c, namespace)
+}
+
+func (r *relay) FindPeers(c *client, namespace string, limit int) error {
+	return r.handler.FindPeers(c, namespace, limit)
+}
+
+func (r *relay) PeerInfo(c *client, peerID string) error {
+	return r.handler.PeerInfo(c, peerID)
+}
+
+func (r *relay) ConnectedPeers(c *client) {
+	r.handler.ConnectedPeers(c)
+}
+
 func (r *relay) CloseClient(c *client) {
+	if r.sessions[c.session] == c {
+		metricClients.Dec()
+	}
+	delete(r.sessions, c.session)
 	r.handler.CloseClient(c)
 }
 
 func (r *relay) init(handler protocolHandler) {
 	r.clients = make(map[*websocket.Conn]*client)
+	r.sessions = make(map[string]*client)
 	r.managementChan = make(chan func())
 	r.handler = handler
 }
 
+// broadcast sends msg to every client
+func (r *relay) broadcast(msg messageParams) {
+	svc(r, func() {
+		for _, c := range r.clients {
+			c := c
+			svc(c, func() {
+				c.writeMsgpack(msg)
+			})
+		}
+	})
+}
+
 func (r *relay) getSvcChannel() chan func() {
 	return r.managementChan
 }
@@ -953,6 +1505,7 @@ func (r *relay) handleConnection() func(http.ResponseWriter, *http.Request) {
 					}
 					if err == nil {
 						fmt.Printf("@@@ READ MESSAGE %s: %X\n", messageType(data[0]).clientName(), data[1:])
+						countMessage("in", cmsgNames[:], messageType(data[0]))
 					} else {
 						fmt.Println("ERROR READING WEB SOCKET", err)
 						con.Close()
@@ -979,7 +1532,7 @@ func (r *relay) handleConnection() func(http.ResponseWriter, *http.Request) {
 					// only continue loop with continue statement
 					return
 				}
-			} else {
+			} else if token := req.URL.Query().Get("session"); token == "" || !r.resumeSession(con, token) {
 				r.runProtocol(con)
 			}
 		}
@@ -992,37 +1545,87 @@ func (r *relay) runProtocol(con *websocket.Conn) {
 		client.control = con
 		r.access = network.ReachabilityUnknown
 		r.clients[con] = client
-		// start websocket ping/pong keepalive
-		con.SetReadDeadline(time.Now().Add(pongWait))
-		con.SetPongHandler(func(string) error { con.SetReadDeadline(time.Now().Add(pongWait)); return nil })
-		go func() {
-			done := new(atomicBoolean)
-			client.ticker = time.NewTicker(pingPeriod)
-			defer client.ticker.Stop()
-			for !done.Get() {
-				_, ok := <-client.ticker.C
-				if ok {
-					svc(client, func() {
-						if err := con.WriteMessage(websocket.PingMessage, nil); err != nil {
-							done.Set(true)
-							client.close()
-						}
-					})
-				} else {
-					break
-				}
-			}
-		}()
+		r.sessions[client.session] = client
+		metricClients.Inc()
+		client.watchWebsocket(con)
 		// start the client, send ident message when ready
 		r.StartClient(client, func(public bool, hasNat bool) {
 			_, v2 := r.Versions()
-			client.writeMsgpack(&smsgIdentParams{public, hasNat, r.peerID, r.handler.AddressArray(), r.handler.PeerKey(), v2})
+			client.writeMsgpack(&smsgIdentParams{public, hasNat, r.peerID, r.handler.AddressArray(), r.handler.PeerKey(), v2, client.session, false})
 			runSvc(client)
 			client.readWebsocket(r)
 		})
 	})
 }
 
+// detachClient keeps a client whose websocket closed so a new websocket can resume its session
+func (r *relay) detachClient(c *client) {
+	if sessionGrace <= 0 {
+		r.CloseClient(c)
+		return
+	}
+	fmt.Printf("DETACHING SESSION %s FOR %v\n", c.session, sessionGrace)
+	delete(r.clients, c.control)
+	c.sessionLock.Lock()
+	c.detached = true
+	c.sessionGen++
+	gen := c.sessionGen
+	c.sessionLock.Unlock()
+	svc(c, func() {
+		if c.control != nil {
+			c.control.Close()
+			c.control = nil
+		}
+	})
+	time.AfterFunc(sessionGrace, func() {
+		svc(r, func() {
+			c.sessionLock.Lock()
+			expired := c.detached && !c.resuming && c.sessionGen == gen
+			c.sessionLock.Unlock()
+			if expired && r.sessions[c.session] == c {
+				fmt.Printf("SESSION %s EXPIRED\n", c.session)
+				r.CloseClient(c)
+			}
+		})
+	})
+}
+
+// resumeSession attaches con to the detached client for token, returning false if there is none
+func (r *relay) resumeSession(con *websocket.Conn, token string) bool {
+	c, _ := svcSync(r, func() interface{} {
+		c := r.sessions[token]
+		if c == nil || !c.claimSession() {return nil}
+		r.clients[con] = c
+		return c
+	}).(*client)
+	if c == nil {return false}
+	fmt.Printf("RESUMING SESSION %s\n", token)
+	r.StartClient(c, func(public bool, hasNat bool) {
+		_, v2 := r.Versions()
+		svc(c, func() {
+			c.sessionLock.Lock()
+			defer c.sessionLock.Unlock()
+			c.control = con
+			c.running = true
+			err := writeMsgpack(con, &smsgIdentParams{public, hasNat, r.peerID, r.handler.AddressArray(), r.handler.PeerKey(), v2, c.session, true})
+			for _, packet := range c.backlog {
+				if err != nil {break}
+				err = con.WriteMessage(websocket.BinaryMessage, packet)
+			}
+			c.backlog = nil
+			c.backlogSize = 0
+			c.detached = false
+			c.resuming = false
+			if err != nil {
+				fmt.Println("ERROR RESUMING SESSION", err)
+			}
+			c.watchWebsocket(con)
+			c.readWebsocket(r)
+		})
+	})
+	return true
+}
+
 func newBuf(len int) *bytes.Buffer {
 	return bytes.NewBuffer(make([]byte, len))
 }
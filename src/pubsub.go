@@ -0,0 +1,112 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+/*
+# PUBSUB
+
+Clients can subscribe and publish to GossipSub topics, so a group of peers can share messages
+without a stream between every pair of them. Messages are signed by their publishers and
+signatures are verified before delivery. Subscribing with FRIENDSONLY drops messages from peers
+who are not friends for that subscription only; other subscribers to the topic still get them.
+Each subscription delivers its messages in the order it receives them.
+*/
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+var topicsLock sync.Mutex
+var topics = make(map[string]*pubsub.Topic) // name -> joined topic
+
+func initPubsub(ctx context.Context) error {
+	ps, err := pubsub.NewGossipSub(ctx, conf.myHost,
+		pubsub.WithMessageSigning(true),
+		pubsub.WithStrictSignatureVerification(true),
+	)
+	if err != nil {return err}
+	conf.pubsub = ps
+	return nil
+}
+
+// joinTopic returns the joined topic for name
+func joinTopic(name string) (*pubsub.Topic, error) {
+	if conf.pubsub == nil {return nil, fmt.Errorf("pubsub is not running")}
+	topicsLock.Lock()
+	defer topicsLock.Unlock()
+	topic := topics[name]
+	if topic == nil {
+		var err error
+		topic, err = conf.pubsub.Join(name)
+		if err != nil {return nil, err}
+		topics[name] = topic
+	}
+	return topic, nil
+}
+
+// fromFriend returns whether this peer or a friend published publisher's message
+func fromFriend(publisher peer.ID) bool {
+	return publisher == conf.myHost.ID() || isFriend(publisher)
+}
+
+func (c *libp2pClient) subscribe(name string, friendsOnly bool) error {
+	if c.subscriptions[name] != nil {return nil}
+	topic, err := joinTopic(name)
+	if err != nil {return err}
+	sub, err := topic.Subscribe()
+	if err != nil {return err}
+	c.subscriptions[name] = sub
+	go func() {
+		for {
+			msg, err := sub.Next(context.Background())
+			if err != nil {return} // canceled
+			publisher := msg.GetFrom()
+			if friendsOnly && !fromFriend(publisher) {continue}
+			svcSync(c, func() interface{} { // wait so messages reach the client in order
+				c.writeMsgpack(&smsgTopicMessageParams{name, publisher.Pretty(), msg.Data})
+				return nil
+			})
+		}
+	}()
+	return nil
+}
+
+func (c *libp2pClient) unsubscribe(name string) {
+	if sub := c.subscriptions[name]; sub != nil {
+		sub.Cancel()
+		delete(c.subscriptions, name)
+	}
+}
+
+func publish(name string, data []byte) error {
+	topic, err := joinTopic(name)
+	if err != nil {return err}
+	return topic.Publish(context.Background(), data)
+}
@@ -0,0 +1,163 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+/*
+# REACHABILITY MONITOR
+
+The monitor checks autonat's reachability and public address. It checks every second at first
+and backs off to maxReachabilityCheck while nothing changes. Autonat reachability events and
+changes found while renewing NAT port mappings wake it immediately and reset the backoff.
+Clients receive Access Change when reachability changes. Autonat's public address is only used
+when no ports are mapped: autonat caches it at each dial-back, while renewals see a moved mapping
+at once (see nat.go).
+
+Clients receive Addresses Changed whenever the host reports new addresses on the event bus,
+whether from NAT mapping, AutoRelay picking a relay, or network interfaces changing, so
+addresses a client saved from Identify do not go stale.
+*/
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	autonat "github.com/libp2p/go-libp2p-autonat"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/network"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	minReachabilityCheck = time.Second
+	maxReachabilityCheck = 5 * time.Minute
+)
+
+var addressChanges = make(chan struct{}, 1)
+
+// noteAddressChange wakes the reachability monitor
+func noteAddressChange() {
+	select {
+	case addressChanges <- struct{}{}:
+	default:
+	}
+}
+
+func (r *libp2pRelay) monitorReachability(ctx context.Context, an autonat.AutoNAT, treeProtocol string) {
+	var events <-chan interface{}
+	sub, err := r.host.EventBus().Subscribe(new(event.EvtLocalReachabilityChanged))
+	if err != nil {
+		fmt.Println("COULD NOT SUBSCRIBE TO REACHABILITY EVENTS:", err)
+	} else {
+		defer sub.Close()
+		events = sub.Out()
+	}
+	delay := minReachabilityCheck
+	timer := time.NewTimer(0)
+	first := true
+	for {
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-events:
+			delay = minReachabilityCheck
+		case <-addressChanges:
+			delay = minReachabilityCheck
+		case <-timer.C:
+		}
+		changed := r.checkReachability(an, first)
+		if first {
+			first = false
+			checkErr(initTree(ctx, treeProtocol))
+		}
+		if changed {
+			delay = minReachabilityCheck
+		} else if delay *= 2; delay > maxReachabilityCheck {
+			delay = maxReachabilityCheck
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(delay)
+	}
+}
+
+// checkReachability updates the NAT status and public address from autonat, returning whether either changed
+func (r *libp2pRelay) checkReachability(an autonat.AutoNAT, first bool) bool {
+	status := natReachability(an.Status())
+	return svcSync(r, func() interface{} {
+		changed := false
+		// autonat's address is only as fresh as its last dial-back, so a NAT mapping owns the address
+		if addr, err := an.PublicAddr(); err == nil && customNatTraversal && transportName(addr) == "tcp" && !portMapped() {
+			if old, _ := publicAddress.Load().(ma.Multiaddr); old == nil || !old.Equal(addr) {
+				fmt.Println("@@@ PUBLIC ADDRESS: ", addr)
+				publicAddress.Store(addr)
+				changed = true
+			}
+		}
+		if status != r.observedStatus || first {
+			r.observedStatus = status
+			fmt.Println("@@@ NAT status", natStatus(status))
+			if status != network.ReachabilityUnknown {
+				r.setNATStatus(status)
+			}
+			accessChan <- status
+			changed = true
+		}
+		return changed
+	}).(bool)
+}
+
+// watchAddresses sends the host's addresses to clients whenever they change
+func (r *libp2pRelay) watchAddresses() error {
+	sub, err := r.host.EventBus().Subscribe(new(event.EvtLocalAddressesUpdated))
+	if err != nil {return err}
+	go func() {
+		defer sub.Close()
+		for range sub.Out() {
+			fmt.Println("@@@ ADDRESSES CHANGED")
+			r.printAddresses()
+			r.broadcastAddresses()
+		}
+	}()
+	return nil
+}
+
+// broadcastAddresses sends each client the addresses as they are when its svc runs, since
+// deliveries for updates close together can run in any order
+func (r *libp2pRelay) broadcastAddresses() {
+	svc(r, func() {
+		for _, c := range r.clients {
+			c := c
+			svc(c, func() {
+				c.writeMsgpack(&smsgAddressesChangedParams{r.AddressArray()})
+			})
+		}
+	})
+}
@@ -0,0 +1,73 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+)
+
+func TestCheckReachability(t *testing.T) {
+	tests := []struct {
+		status  network.Reachability // from autonat
+		changed bool
+		applied network.Reachability // natStatus afterwards
+	}{
+		{network.ReachabilityPublic, true, network.ReachabilityPublic},
+		{network.ReachabilityPublic, false, network.ReachabilityPublic},
+		{network.ReachabilityUnknown, true, network.ReachabilityPublic},
+		{network.ReachabilityUnknown, false, network.ReachabilityPublic},
+		{network.ReachabilityPrivate, true, network.ReachabilityPrivate},
+	}
+	atomic.StoreInt32(&portMappingLost, 0)
+	r := &libp2pRelay{}
+	r.managementChan = make(chan func())
+	runSvc(r)
+	defer close(r.managementChan)
+	for i, test := range tests {
+		sent := make(chan bool)
+		go func() {
+			select {
+			case <-accessChan:
+				sent <- true
+			case <-time.After(100 * time.Millisecond):
+				sent <- false
+			}
+		}()
+		changed := r.checkReachability(fakeAutoNAT{test.status, nil}, i == 0)
+		if <-sent != test.changed {
+			t.Errorf("check %d: sent Access Change = %v, want %v", i, !test.changed, test.changed)
+		}
+		if changed != test.changed {
+			t.Errorf("check %d: changed = %v, want %v", i, changed, test.changed)
+		}
+		if r.natStatus != test.applied {
+			t.Errorf("check %d: NAT status %s, want %s", i, natStatus(r.natStatus), natStatus(test.applied))
+		}
+	}
+}
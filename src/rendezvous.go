@@ -0,0 +1,99 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+/*
+# RENDEZVOUS
+
+Clients can advertise this peer under a namespace and find other peers advertising the same
+namespace, using the DHT. Advertisements are renewed until the client stops them or closes.
+Each peer FindPeers discovers is sent as a Peer Found message as soon as it arrives, followed
+by Find Peers Done when the search ends. The search stops when the client closes.
+*/
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	coredisc "github.com/libp2p/go-libp2p-core/discovery"
+	discovery "github.com/libp2p/go-libp2p-discovery"
+)
+
+const findPeersTimeout = time.Minute
+
+func (c *libp2pClient) advertise(ns string) error {
+	r := c.libp2pRelay()
+	if r.discovery == nil {return fmt.Errorf("discovery requires the DHT")}
+	if c.advertisements[ns] != nil {return nil}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.advertisements[ns] = cancel
+	fmt.Println("ADVERTISING", ns)
+	discovery.Advertise(ctx, r.discovery, ns)
+	return nil
+}
+
+func (c *libp2pClient) stopAdvertising(ns string) {
+	if cancel := c.advertisements[ns]; cancel != nil {
+		fmt.Println("STOPPED ADVERTISING", ns)
+		cancel()
+		delete(c.advertisements, ns)
+	}
+}
+
+// findPeers sends each peer found in ns to the client as it arrives
+func (c *libp2pClient) findPeers(ns string, limit int) error {
+	r := c.libp2pRelay()
+	if r.discovery == nil {return fmt.Errorf("discovery requires the DHT")}
+	var opts []coredisc.Option
+	if limit > 0 {
+		opts = append(opts, coredisc.Limit(limit))
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, findPeersTimeout)
+	peers, err := r.discovery.FindPeers(ctx, ns, opts...)
+	if err != nil {
+		cancel()
+		return err
+	}
+	go func() {
+		defer cancel()
+		for addrInfo := range peers {
+			if addrInfo.ID == r.host.ID() || len(addrInfo.Addrs) == 0 {continue}
+			addrs := make([]string, len(addrInfo.Addrs))
+			for i, addr := range addrInfo.Addrs {
+				addrs[i] = addr.String()
+			}
+			peerID := addrInfo.ID.Pretty()
+			svcSync(c, func() interface{} { // wait so Find Peers Done comes after every Peer Found
+				c.writeMsgpack(&smsgPeerFoundParams{ns, peerID, addrs})
+				return nil
+			})
+		}
+		svc(c, func() {
+			c.writeMsgpack(&smsgFindPeersDoneParams{ns})
+		})
+	}()
+	return nil
+}
@@ -0,0 +1,219 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+/*
+# ENCRYPTED SHARING
+
+Files can be shared with a chosen set of friends. The file is encrypted with a random
+AES-256-GCM content key and the content key is wrapped with RSA-OAEP for each recipient's
+public key (from the peerstore). The sender is always a recipient so it can read its own files.
+The encrypted envelope is stored in IPFS and pinned.
+
+```
+  POST /share/NAME?to=PEERID,PEERID -- encrypt the request body to the friends, returns {"Cid": CID}
+  GET  /shared/CID                  -- fetch and decrypt a shared file for this peer
+```
+*/
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const shareKeyLabel = "libp2p-websocket share"
+
+// sharedEnvelope is the JSON stored in IPFS for a shared file
+type sharedEnvelope struct {
+	Name   string
+	Sender string
+	Keys   map[string][]byte // peerID -> wrapped content key
+	Nonce  []byte
+	Data   []byte // AES-GCM sealed file contents
+}
+
+func peerPublicKey(peerID peer.ID) (crypto.PubKey, error) {
+	if pub := conf.myHost.Peerstore().PubKey(peerID); pub != nil {return pub, nil}
+	pub, err := peerID.ExtractPublicKey()
+	if err != nil || pub == nil {return nil, fmt.Errorf("no public key known for %s", peerID.Pretty())}
+	return pub, nil
+}
+
+func wrapContentKey(pub crypto.PubKey, key []byte) ([]byte, error) {
+	stdKey, err := crypto.PubKeyToStdKey(pub)
+	if err != nil {return nil, err}
+	rsaKey, ok := stdKey.(*rsa.PublicKey)
+	if !ok {return nil, fmt.Errorf("cannot encrypt to a %s key", pub.Type())}
+	return rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaKey, key, []byte(shareKeyLabel))
+}
+
+func unwrapContentKey(priv crypto.PrivKey, wrapped []byte) ([]byte, error) {
+	stdKey, err := crypto.PrivKeyToStdKey(priv)
+	if err != nil {return nil, err}
+	rsaKey, ok := stdKey.(*rsa.PrivateKey)
+	if !ok {return nil, fmt.Errorf("cannot decrypt with a %s key", priv.Type())}
+	return rsa.DecryptOAEP(sha256.New(), rand.Reader, rsaKey, wrapped, []byte(shareKeyLabel))
+}
+
+// encryptForFriends seals data for the recipients, which must all be friends
+func encryptForFriends(name string, data []byte, recipients []peer.ID) (*sharedEnvelope, error) {
+	contentKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, contentKey); err != nil {return nil, err}
+	env := &sharedEnvelope{
+		Name:   name,
+		Sender: conf.myHost.ID().Pretty(),
+		Keys:   make(map[string][]byte),
+	}
+	recipients = append(recipients, conf.myHost.ID())
+	for _, recipient := range recipients {
+		if recipient != conf.myHost.ID() && !isFriend(recipient) {
+			return nil, fmt.Errorf("%s is not a friend", recipient.Pretty())
+		}
+		pub, err := peerPublicKey(recipient)
+		if err != nil {return nil, err}
+		wrapped, err := wrapContentKey(pub, contentKey)
+		if err != nil {return nil, fmt.Errorf("could not wrap key for %s: %w", recipient.Pretty(), err)}
+		env.Keys[recipient.Pretty()] = wrapped
+	}
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {return nil, err}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {return nil, err}
+	env.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, env.Nonce); err != nil {return nil, err}
+	env.Data = gcm.Seal(nil, env.Nonce, data, []byte(name))
+	return env, nil
+}
+
+// decrypt opens the envelope with the local peer key
+func (env *sharedEnvelope) decrypt() ([]byte, error) {
+	wrapped := env.Keys[conf.myHost.ID().Pretty()]
+	if wrapped == nil {return nil, fmt.Errorf("file %s was not shared with this peer", env.Name)}
+	contentKey, err := unwrapContentKey(conf.peerKey, wrapped)
+	if err != nil {return nil, err}
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {return nil, err}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {return nil, err}
+	return gcm.Open(nil, env.Nonce, env.Data, []byte(env.Name))
+}
+
+// publishShared encrypts a file for the recipients and stores and pins the envelope in IPFS
+func publishShared(ctx context.Context, name string, data []byte, recipients []peer.ID) (cid.Cid, error) {
+	if conf.lite == nil {return cid.Undef, fmt.Errorf("IPFS is not running")}
+	env, err := encryptForFriends(name, data, recipients)
+	if err != nil {return cid.Undef, err}
+	envBytes, err := json.Marshal(env)
+	if err != nil {return cid.Undef, err}
+	node, err := conf.lite.AddFile(ctx, bytes.NewReader(envBytes), nil)
+	if err != nil {return cid.Undef, err}
+	if err := conf.pin.Pin(ctx, node, true); err != nil {return cid.Undef, err}
+	if err := conf.pin.Flush(ctx); err != nil {return cid.Undef, err}
+	fmt.Printf("SHARED %s WITH %v AS %s\n", name, recipients, node.Cid())
+	return node.Cid(), nil
+}
+
+// fetchShared gets a shared file from IPFS and decrypts it for this peer
+func fetchShared(ctx context.Context, c cid.Cid) (string, []byte, error) {
+	if conf.lite == nil {return "", nil, fmt.Errorf("IPFS is not running")}
+	file, err := conf.lite.GetFile(ctx, c)
+	if err != nil {return "", nil, err}
+	defer file.Close()
+	envBytes, err := ioutil.ReadAll(file)
+	if err != nil {return "", nil, err}
+	env := new(sharedEnvelope)
+	if err := json.Unmarshal(envBytes, env); err != nil {return "", nil, fmt.Errorf("%s is not a shared file: %w", c, err)}
+	data, err := env.decrypt()
+	if err != nil {return "", nil, err}
+	return env.Name, data, nil
+}
+
+func handleShare(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Path[len("/share/"):]
+	fmt.Printf("Handling %s (%s)\n", r.URL, name)
+	if r.Method != http.MethodPost {
+		httpError(w, "Sharing requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var recipients []peer.ID
+	for _, friend := range strings.Split(r.URL.Query().Get("to"), ",") {
+		if friend == "" {continue}
+		friendPeer, err := peer.Decode(friend)
+		if err != nil {
+			httpError(w, fmt.Sprintf("Bad peer id: %s", friend), http.StatusBadRequest)
+			return
+		}
+		recipients = append(recipients, friendPeer)
+	}
+	if len(recipients) == 0 {
+		httpError(w, "No recipients, use ?to=PEERID,PEERID", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, errstr("Could not read request body"), http.StatusBadRequest)
+		return
+	}
+	c, err := publishShared(r.Context(), name, data, recipients)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	output, _ := json.Marshal(map[string]string{"Cid": c.String()})
+	http.ServeContent(w, r, "output.json", time.Now(), bytes.NewReader(output))
+}
+
+func handleShared(w http.ResponseWriter, r *http.Request) {
+	cidString := r.URL.Path[len("/shared/"):]
+	fmt.Printf("Handling %s (%s)\n", r.URL, cidString)
+	c, err := cid.Decode(cidString)
+	if err != nil {
+		httpError(w, fmt.Sprintf("Bad cid: %s", cidString), http.StatusBadRequest)
+		return
+	}
+	name, data, err := fetchShared(r.Context(), c)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.ServeContent(w, r, name, time.Now(), bytes.NewReader(data))
+}
@@ -0,0 +1,192 @@
+/* Copyright (c) 2020, William R. Burdick Jr., Roy Riggs, and TEAM CTHLUHU
+ *
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+
+package main
+
+/*
+# STATUS
+
+/status shows the relay's internals as JSON and /status.html shows them as a page. They are
+served on the same port as /libp2p.
+
+```
+  PeerID, NATStatus, HasNAT, PublicAddress, ListenAddrs -- this peer and how it is reached
+  ConnectedPeers                                        -- peers the host is connected to
+  RoutingTable                                          -- peers in the WAN and LAN DHT routing tables
+  Clients                                               -- websocket clients with their listeners and connections
+  DatastoreSize                                         -- bytes used by the datastore, -1 if unknown
+  Version, CurrentVersion                               -- from Versions()
+```
+
+Until a client starts the peer, only Started, HasNAT and the versions are filled in.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+type relayStatus struct {
+	Started        bool
+	PeerID         string
+	NATStatus      string
+	HasNAT         bool
+	PublicAddress  string
+	ListenAddrs    []string
+	ConnectedPeers int
+	RoutingTable   struct{ WAN, LAN int }
+	Clients        []clientStatus
+	DatastoreSize  int64
+	Version        string
+	CurrentVersion string
+}
+
+type clientStatus struct {
+	Number      uint64
+	Detached    bool
+	Listeners   []string // protocols
+	Connections []clientConnectionStatus
+}
+
+type clientConnectionStatus struct {
+	ConnectionID uint64
+	PeerID       string
+	Protocol     string
+	BytesIn      int64
+	BytesOut     int64
+}
+
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Relay status</title></head>
+<body>
+<h1>Relay {{.PeerID}}</h1>
+<table>
+<tr><th align="left">Started</th><td>{{.Started}}</td></tr>
+<tr><th align="left">NAT status</th><td>{{.NATStatus}}</td></tr>
+<tr><th align="left">Has NAT</th><td>{{.HasNAT}}</td></tr>
+<tr><th align="left">Public address</th><td>{{.PublicAddress}}</td></tr>
+<tr><th align="left">Listen addresses</th><td>{{range .ListenAddrs}}{{.}}<br>{{end}}</td></tr>
+<tr><th align="left">Connected peers</th><td>{{.ConnectedPeers}}</td></tr>
+<tr><th align="left">Routing table</th><td>WAN {{.RoutingTable.WAN}}, LAN {{.RoutingTable.LAN}}</td></tr>
+<tr><th align="left">Datastore size</th><td>{{.DatastoreSize}}</td></tr>
+<tr><th align="left">Version</th><td>{{.Version}}, current {{.CurrentVersion}}</td></tr>
+</table>
+{{range .Clients}}
+<h2>Client {{.Number}}{{if .Detached}} (detached){{end}}</h2>
+<p>Listening on: {{range .Listeners}}{{.}} {{else}}nothing{{end}}</p>
+<table>
+<tr><th>ID</th><th>Peer</th><th>Protocol</th><th>Bytes in</th><th>Bytes out</th></tr>
+{{range .Connections}}<tr><td>{{.ConnectionID}}</td><td>{{.PeerID}}</td><td>{{.Protocol}}</td><td>{{.BytesIn}}</td><td>{{.BytesOut}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+func (r *libp2pRelay) status() *relayStatus {
+	st := &relayStatus{Started: started, HasNAT: hasNat, DatastoreSize: -1}
+	st.Version, st.CurrentVersion = r.Versions()
+	if !started {return st} // the relay's service does not run until the peer starts
+	var clients []*client
+	var peers []connectedPeerInfo
+	svcSync(r, func() interface{} {
+		st.PeerID = r.peerID
+		st.NATStatus = natStatus(r.natStatus)
+		for _, c := range r.sessions {
+			clients = append(clients, c)
+		}
+		peers = r.connectedPeerList()
+		return nil
+	})
+	connections := make(map[uint64][]clientConnectionStatus) // client number -> connections
+	for _, p := range peers {
+		for _, con := range p.Connections {
+			connections[con.Client] = append(connections[con.Client], clientConnectionStatus{con.ConnectionID, p.PeerID, con.Protocol, con.BytesIn, con.BytesOut})
+		}
+	}
+	for _, c := range clients {
+		lc := getLibp2pClient(c)
+		listeners := svcSync(c, func() interface{} {
+			protocols := make([]string, 0, len(lc.listeners))
+			for prot := range lc.listeners {
+				protocols = append(protocols, prot)
+			}
+			return protocols
+		}).([]string)
+		sort.Strings(listeners)
+		cons := connections[c.number]
+		sort.Slice(cons, func(i, j int) bool { return cons[i].ConnectionID < cons[j].ConnectionID })
+		st.Clients = append(st.Clients, clientStatus{c.number, c.isDetached(), listeners, cons})
+	}
+	sort.Slice(st.Clients, func(i, j int) bool { return st.Clients[i].Number < st.Clients[j].Number })
+	if r.host == nil {return st}
+	if addr, _ := publicAddress.Load().(ma.Multiaddr); addr != nil && atomic.LoadInt32(&portMappingLost) == 0 {
+		st.PublicAddress = addr.String()
+	}
+	if addrs, err := r.host.Network().InterfaceListenAddresses(); err == nil {
+		for _, addr := range addrs {
+			st.ListenAddrs = append(st.ListenAddrs, addr.String())
+		}
+	}
+	st.ConnectedPeers = len(r.host.Network().Peers())
+	if conf.dht != nil {
+		st.RoutingTable.WAN = conf.dht.WAN.RoutingTable().Size()
+		st.RoutingTable.LAN = conf.dht.LAN.RoutingTable().Size()
+	}
+	if pds, ok := conf.dstor.(datastore.PersistentDatastore); ok {
+		if size, err := pds.DiskUsage(); err == nil {
+			st.DatastoreSize = int64(size)
+		}
+	}
+	return st
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	st := centralRelay.status()
+	output, err := json.Marshal(st)
+	if err != nil {
+		httpError(w, errstr("Could not encode result %v", st), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, "output.json", time.Now(), bytes.NewReader(output))
+}
+
+func handleStatusPage(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := statusPage.Execute(&buf, centralRelay.status()); err != nil {
+		httpError(w, errstr("Could not render status: %v", err), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, "status.html", time.Now(), bytes.NewReader(buf.Bytes()))
+}